@@ -2,11 +2,13 @@ package application
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/lvkeliang/P2Pin3/bitfield"
 	"github.com/lvkeliang/P2Pin3/handshake"
 	"github.com/lvkeliang/P2Pin3/logic"
+	"github.com/lvkeliang/P2Pin3/wiretrace"
 	"net"
 	"time"
 )
@@ -49,7 +51,7 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 		return nil, err
 	}
 	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg)
+		err := fmt.Errorf("Expected bitfield but got keep-alive")
 		return nil, err
 	}
 	if msg.ID != logic.MsgBitfield {
@@ -63,10 +65,23 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 // New connects with a peer, completes a handshake, and receives a handshake
 // returns an err if any of those fail.
 func New(peer logic.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 15*time.Second)
+	return Dial(context.Background(), peer, peerID, infoHash)
+}
+
+// Dial is like New but gives up connecting once ctx is cancelled
+func Dial(ctx context.Context, peer logic.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return DialTraced(ctx, peer, peerID, infoHash, nil)
+}
+
+// DialTraced is like Dial, recording the handshake and every message of the
+// connection with tracer
+func DialTraced(ctx context.Context, peer logic.Peer, peerID, infoHash [20]byte, tracer *wiretrace.Tracer) (*Client, error) {
+	dialer := net.Dialer{Timeout: 15 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
 	if err != nil {
 		return nil, err
 	}
+	conn = tracer.Conn(conn)
 
 	_, err = CompleteHandshake(conn, infoHash, peerID)
 	if err != nil {
@@ -101,8 +116,6 @@ func (c *Client) Read() (*logic.Message, error) {
 // SendRequest sends a Request message to the peer
 func (c *Client) SendRequest(index, begin, length int) error {
 	req := logic.FormatRequest(index, begin, length)
-	//fmt.Printf("application-SendRequesr-index: %v ,begin: %v ,length: %v\n", index, begin, length)
-	// fmt.Printf("Serialize: %v\n", req.Serialize())
 	_, err := c.Conn.Write(req.Serialize())
 	return err
 }
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/protocol"
 	"github.com/lvkeliang/P2Pin3/torrent"
-	"log"
 	"os"
+	"os/signal"
+	"time"
 )
 
 func main() {
+	err := run()
+	if err != nil {
+		logging.For(logging.Protocol).Error("download stopped", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+func run() error {
 	//inPath := "F:\\torrent\\[ANi] 殭屍 100～在成為殭屍前要做的 100 件事～ - 01 [1080P][Baha][WEB-DL][AAC AVC][CHT].mp4.torrent"
 	outPath := "./downloaded/"
 	var hashmapPath = "./hashmap/hashmap.json"
@@ -16,17 +28,17 @@ func main() {
 	filePath := "./testdata/" + name
 	newtorrent, err := torrent.NewTorrentFile(filePath, "http://localhost:8090/announce", 12*1024)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	err = newtorrent.SaveTorrentFile(filePath, "./have/"+name+".json", hashmapPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	t, err := torrent.LoadTorrentFile("./have/" + name + ".json")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	//tf, err := torrent.Open(inPath)
@@ -39,14 +51,28 @@ func main() {
 		// 如果文件夹不存在，则创建文件夹
 		err := os.MkdirAll(outPath, 0755)
 		if err != nil {
-			fmt.Println("Error creating folder:", err)
-			return
+			return err
 		}
 	}
 
-	err = t.DownloadToFile(outPath+t.Name, hashmapPath)
+	// Ctrl+C stops the download instead of killing it half way
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	dl, err := t.NewDownload(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	dl.OnEvent = func(e protocol.Event) {
+		if e.Type != protocol.EventPieceVerified && e.Type != protocol.EventProgress {
+			return
+		}
+		p := e.Progress
+		fmt.Printf("\r(%0.2f%%) 已下载 %d/%d 块，来自 %d 个节点，速度: %0.2f MB/s，剩余: %v   ",
+			p.Percent(), p.PiecesDone, p.PiecesTotal, p.Peers, p.Rate/1048576, p.ETA.Round(time.Second))
 	}
 
+	err = t.RunDownload(ctx, dl, outPath+t.Name, hashmapPath)
+	fmt.Printf("\n")
+	return err
 }
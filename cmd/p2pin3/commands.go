@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/hooks"
+	"github.com/lvkeliang/P2Pin3/library"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/metrics"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/resume"
+	"github.com/lvkeliang/P2Pin3/seeder"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/stream"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"github.com/lvkeliang/P2Pin3/tracker"
+	"github.com/lvkeliang/P2Pin3/watch"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: p2pin3 %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a command and checks it got n arguments
+func parseArgs(fs *flag.FlagSet, args []string, n int) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	return nil
+}
+
+// signalContext is cancelled by Ctrl+C, so downloads and servers stop
+// cleanly instead of being killed half way
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// storageUsage describes the -storage flag of download, seed and daemon
+const storageUsage = "数据的存储方式：file 为普通文件，下载完成前带 .part 后缀；mmap 把文件映射到内存，开始下载时即按完整大小创建"
+
+// loadTorrent reads a .torrent file or a torrent saved by create, or
+// resolves a magnet link given directly or in a file
+func loadTorrent(cfg *config, arg string) (*torrent.TorrentFile, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return torrent.ResolveMagnet(arg, cfg.LibraryPath, cfg.TorrentDir)
+	}
+	data, err := ioutil.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "magnet:") {
+		return torrent.ResolveMagnet(string(data), cfg.LibraryPath, cfg.TorrentDir)
+	}
+	t, err := torrent.LoadTorrentFile(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", arg, err)
+	}
+	return &t, nil
+}
+
+func runCreate(cfg *config, args []string) error {
+	fs := newFlagSet("create")
+	announce := fs.String("announce", cfg.Announce, "tracker 的 URL")
+	pieceLength := fs.Int("piece-length", cfg.PieceLength, "数据块大小（字节）")
+	out := fs.String("o", "", "种子保存位置（默认为 TorrentDir 中的 <文件名>.json）")
+	err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	path := fs.Arg(0)
+	if *out == "" {
+		*out = filepath.Join(cfg.TorrentDir, filepath.Base(path)+".json")
+	}
+	err = os.MkdirAll(filepath.Dir(*out), 0755)
+	if err != nil {
+		return err
+	}
+
+	t, err := torrent.NewTorrentFile(path, *announce, *pieceLength)
+	if err != nil {
+		return err
+	}
+	err = t.SaveTorrentFile(path, *out, cfg.LibraryPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println("种子已保存到", *out)
+	fmt.Println("infohash:", hex.EncodeToString(t.InfoHash[:]))
+	fmt.Println("magnet:  ", t.MagnetLink())
+	return nil
+}
+
+func runInfo(cfg *config, args []string) error {
+	fs := newFlagSet("info")
+	err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	t, err := loadTorrent(cfg, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println("名称:    ", t.Name)
+	fmt.Println("infohash:", hex.EncodeToString(t.InfoHash[:]))
+	fmt.Println("magnet:  ", t.MagnetLink())
+	fmt.Println("tracker: ", t.Announce)
+	fmt.Printf("大小:     %d 字节\n", t.Length)
+	fmt.Printf("数据块:   %d 个，每块 %d 字节\n", len(t.PieceHashes), t.PieceLength)
+	if len(t.Files) > 0 {
+		fmt.Printf("文件:     %d 个\n", len(t.Files))
+		for _, f := range t.Files {
+			fmt.Printf("  %12d  %s\n", f.Length, f.Path)
+		}
+	}
+	return nil
+}
+
+func runDownload(cfg *config, args []string) error {
+	fs := newFlagSet("download")
+	out := fs.String("o", cfg.DownloadDir, "下载到的文件夹")
+	streamAddr := fs.String("stream", cfg.StreamAddr, "边下边播的 HTTP 监听地址，为空时不启用")
+	sequential := fs.Bool("sequential", false, "按顺序下载")
+	fullScreen := fs.Bool("tui", false, "以全屏界面显示进度、块图、节点和 tracker 状态")
+	tracePath := fs.String("trace", "", traceUsage)
+	storageName := fs.String("storage", cfg.Storage, storageUsage)
+	err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	backend, err := storage.ParseBackend(*storageName)
+	if err != nil {
+		return err
+	}
+	t, err := loadTorrent(cfg, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	dl, err := t.NewDownload(ctx)
+	if err != nil {
+		return err
+	}
+	dl.Trace, err = openTrace(*tracePath)
+	if err != nil {
+		return err
+	}
+	defer dl.Trace.Close()
+	announces := torrent.NewTracker(t)
+	announces.Follow(dl)
+	if !*fullScreen {
+		dl.OnEvent = printProgress
+	}
+	dl.Sequential = *sequential || *streamAddr != ""
+	if *streamAddr != "" {
+		// Listening first stops the command when the address is taken,
+		// instead of downloading with nowhere to play from
+		l, err := net.Listen("tcp", *streamAddr)
+		if err != nil {
+			return fmt.Errorf("stream server: %w", err)
+		}
+		defer l.Close()
+		streamServer := stream.NewServer()
+		streamServer.Add(dl)
+		go func() {
+			err := http.Serve(l, streamServer)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				logging.For(logging.Stream).Error("stream server stopped", logging.Err(err))
+			}
+		}()
+		fmt.Printf("在线播放: http://%s%s\n", *streamAddr, stream.Path(dl, 0))
+	}
+
+	path := filepath.Join(*out, t.Name)
+	dl.Storage, err = backend.Create(path, dl.Layout())
+	if err != nil {
+		return err
+	}
+	if *fullScreen {
+		stopScreen := showDownload(ctx, t, dl, announces)
+		err = t.RunDownload(ctx, dl, path, cfg.LibraryPath)
+		stopScreen()
+		printProgress(protocol.Event{Type: protocol.EventProgress, Progress: dl.Stats()})
+	} else {
+		err = t.RunDownload(ctx, dl, path, cfg.LibraryPath)
+	}
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	return cfg.hookRunner().Run(ctx, hooks.Completed(t, path))
+}
+
+func printProgress(e protocol.Event) {
+	if e.Type != protocol.EventPieceVerified && e.Type != protocol.EventProgress {
+		return
+	}
+	p := e.Progress
+	fmt.Printf("\r(%0.2f%%) 已下载 %d/%d 块，来自 %d 个节点，速度: %0.2f MB/s，剩余: %v   ",
+		p.Percent(), p.PiecesDone, p.PiecesTotal, p.Peers, p.Rate/1048576, p.ETA.Round(time.Second))
+}
+
+func runSeed(cfg *config, args []string) error {
+	fs := newFlagSet("seed")
+	addr := fs.String("listen", cfg.SeedAddr, "监听地址")
+	share := fs.String("share", cfg.ShareDir, "自动做种其中文件的文件夹，为空时不启用")
+	inbox := fs.String("inbox", cfg.InboxDir, "自动下载其中种子（.torrent、.json 或含 magnet 链接的 .magnet）的文件夹，为空时不启用；magnet 链接只能解析种子库或种子目录中已有元数据的种子")
+	interval := fs.Duration("announce-interval", tracker.DefaultInterval, "向 tracker 报告的间隔")
+	metricsAddr := fs.String("metrics", cfg.MetricsAddr, "Prometheus 指标（/metrics）的监听地址，为空时不启用")
+	tracePath := fs.String("trace", "", traceUsage)
+	storageName := fs.String("storage", cfg.Storage, storageUsage)
+	err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	backend, err := storage.ParseBackend(*storageName)
+	if err != nil {
+		return err
+	}
+	tracer, err := openTrace(*tracePath)
+	if err != nil {
+		return err
+	}
+	defer tracer.Close()
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	registry := seeder.NewRegistry()
+	registry.Storage = backend
+	err = registry.Load(cfg.LibraryPath, cfg.TorrentDir)
+	if err != nil {
+		return err
+	}
+	go registry.Watch(ctx, cfg.LibraryPath, cfg.TorrentDir, time.Second)
+	runner := cfg.hookRunner()
+	defer runner.Wait()
+	if *share != "" || *inbox != "" {
+		watcher := &watch.Watcher{
+			ShareDir:    *share,
+			InboxDir:    *inbox,
+			DownloadDir: cfg.DownloadDir,
+			TorrentDir:  cfg.TorrentDir,
+			LibraryPath: cfg.LibraryPath,
+			Announce:    cfg.Announce,
+			PieceLength: cfg.PieceLength,
+			Interval:    time.Second,
+			Registry:    registry,
+			Hooks:       runner,
+		}
+		go func() {
+			err := watcher.Run(ctx)
+			if err != nil && ctx.Err() == nil {
+				logging.For(logging.Watch).Error("watcher stopped", logging.Err(err))
+			}
+		}()
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	go registry.Announce(ctx, peerID, uint16(port), *interval)
+	if *metricsAddr != "" {
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, metrics.Handler(registry.WriteMetrics))
+			if err != nil {
+				logging.For(logging.Metrics).Error("metrics server stopped", logging.Err(err))
+			}
+		}()
+		fmt.Printf("指标: http://%s/metrics\n", *metricsAddr)
+	}
+
+	fmt.Printf("正在 %s 上为 %d 个种子做种\n", listener.Addr(), len(registry.Seeds()))
+	server := &seeder.Server{Registry: registry, PeerID: peerID, Trace: tracer}
+	err = server.Serve(listener)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func runVerify(cfg *config, args []string) error {
+	fs := newFlagSet("verify")
+	data := fs.String("data", "", "数据的位置（默认为种子库中记录的位置或 DownloadDir 中的同名文件）")
+	err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	t, err := loadTorrent(cfg, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	path := *data
+	if path == "" {
+		path, err = dataPath(cfg, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	have := resume.NewCache().Bitfield(t, path)
+	var missing []int
+	for i := range t.PieceHashes {
+		if !have.HasPiece(i) {
+			missing = append(missing, i)
+		}
+	}
+	fmt.Printf("%s: %d/%d 块完整\n", path, len(t.PieceHashes)-len(missing), len(t.PieceHashes))
+	if len(missing) > 0 {
+		fmt.Println("缺失或损坏的块:", pieceRanges(missing))
+		return fmt.Errorf("%d 个块缺失或损坏", len(missing))
+	}
+	return nil
+}
+
+// dataPath returns where the library says the data of t is, or where
+// download would put it
+func dataPath(cfg *config, t *torrent.TorrentFile) (string, error) {
+	db, err := library.Open(cfg.LibraryPath)
+	if err != nil {
+		return "", err
+	}
+	e, err := db.Get(t.InfoHash)
+	if err != nil {
+		return "", err
+	}
+	if e != nil {
+		return e.Path, nil
+	}
+	return filepath.Join(cfg.DownloadDir, t.Name), nil
+}
+
+// pieceRanges formats sorted piece indexes as "1-3, 7, 9-10"
+func pieceRanges(pieces []int) string {
+	var parts []string
+	for i := 0; i < len(pieces); {
+		j := i
+		for j+1 < len(pieces) && pieces[j+1] == pieces[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(pieces[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", pieces[i], pieces[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+func runTracker(cfg *config, args []string) error {
+	fs := newFlagSet("tracker")
+	addr := fs.String("listen", cfg.TrackerAddr, "监听地址")
+	static := fs.String("static", "", "总是返回的 peer，以逗号分隔的 host:port 列表")
+	err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	var peers []tracker.Peer
+	for i, hostPort := range strings.Split(*static, ",") {
+		if hostPort == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("bad port in %q", hostPort)
+		}
+		peers = append(peers, tracker.Peer{ID: fmt.Sprintf("peer%d", i+1), IP: host, Port: p})
+	}
+
+	trk := tracker.New(peers)
+	mux := http.NewServeMux()
+	mux.Handle("/announce", trk)
+	mux.Handle("/metrics", metrics.Handler(trk.WriteMetrics))
+	server := &http.Server{Addr: *addr, Handler: mux}
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	fmt.Printf("tracker 正在监听 %s\n", *addr)
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/daemon"
+	"github.com/lvkeliang/P2Pin3/session"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/tracker"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runDaemon(cfg *config, args []string) error {
+	fs := newFlagSet("daemon")
+	rpcAddr := fs.String("rpc", cfg.RPCAddr, "JSON-RPC API 和网页界面的监听地址")
+	addr := fs.String("listen", cfg.SeedAddr, "做种的监听地址")
+	interval := fs.Duration("announce-interval", tracker.DefaultInterval, "向 tracker 报告的间隔")
+	maxConns := fs.Int("max-conns", cfg.MaxConns, "所有种子合计的最大连接数，0 表示不限")
+	maxHalfOpen := fs.Int("max-half-open", cfg.MaxHalfOpen, "同时发起的最大连接数，0 表示不限")
+	maxDownloads := fs.Int("max-downloads", cfg.MaxActiveDownloads, "同时下载的最大种子数，其余排队，0 表示不限")
+	maxSeeds := fs.Int("max-seeds", cfg.MaxActiveSeeds, "同时做种的最大种子数，其余排队，0 表示不限")
+	down := fs.Int64("down", cfg.DownloadLimit, "下载限速，字节/秒，0 表示不限")
+	up := fs.Int64("up", cfg.UploadLimit, "上传限速，字节/秒，0 表示不限")
+	altDown := fs.Int64("alt-down", cfg.AltDownloadLimit, "备用下载限速，字节/秒，0 表示不限")
+	altUp := fs.Int64("alt-up", cfg.AltUploadLimit, "备用上传限速，字节/秒，0 表示不限")
+	altSchedule := fs.String("alt-schedule", formatSchedule(cfg.AltSchedule), "启用备用限速的时段，如 08:00-18:00 或 23:00-07:00/mon,tue,wed")
+	tracePath := fs.String("trace", "", traceUsage)
+	storageName := fs.String("storage", cfg.Storage, storageUsage)
+	err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	schedule, err := parseSchedule(*altSchedule)
+	if err != nil {
+		return err
+	}
+	backend, err := storage.ParseBackend(*storageName)
+	if err != nil {
+		return err
+	}
+	runner := cfg.hookRunner()
+	tracer, err := openTrace(*tracePath)
+	if err != nil {
+		return err
+	}
+	defer tracer.Close()
+
+	sess, err := session.New(session.Config{
+		DownloadDir:        cfg.DownloadDir,
+		LibraryPath:        cfg.LibraryPath,
+		TorrentDir:         cfg.TorrentDir,
+		ListenAddr:         *addr,
+		AnnounceInterval:   *interval,
+		MaxConns:           *maxConns,
+		MaxHalfOpen:        *maxHalfOpen,
+		MaxActiveDownloads: *maxDownloads,
+		MaxActiveSeeds:     *maxSeeds,
+		DownloadLimit:      *down,
+		UploadLimit:        *up,
+		AltDownloadLimit:   *altDown,
+		AltUploadLimit:     *altUp,
+		AltSchedule:        schedule,
+		Hooks:              runner,
+		Trace:              tracer,
+		Storage:            backend,
+	})
+	if err != nil {
+		return err
+	}
+	defer runner.Wait()
+	defer sess.Close()
+
+	rpc := &http.Server{Addr: *rpcAddr, Handler: daemon.NewServer(sess)}
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		rpc.Close()
+	}()
+
+	fmt.Printf("守护进程已启动：网页界面 http://%s/，API http://%s/rpc，做种地址 %s，共 %d 个种子\n", *rpcAddr, *rpcAddr, sess.Addr(), len(sess.Torrents()))
+	err = rpc.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ctlCommands are the actions of ctl, each with its usage
+var ctlCommands = map[string]string{
+	"add":      "add [-paused] <种子|magnet>",
+	"list":     "list",
+	"info":     "info <id>",
+	"stats":    "stats",
+	"pause":    "pause <id>",
+	"resume":   "resume <id>",
+	"remove":   "remove [-delete] <id>",
+	"limits":   "limits <下载限速> <上传限速>   单位为字节/秒，0 表示不限速",
+	"priority": "priority <id> <文件序号> <normal|high|skip>",
+	"queue":    "queue <id> <位置|top|up|down|bottom>   调整排队顺序，位置从 0 开始",
+	"active":   "active <下载数> <做种数>   同时下载和做种的最大种子数，0 表示不限",
+	"alt":      "alt <on|off> | alt limits <下载限速> <上传限速> | alt schedule <时段|off>",
+	"top":      "top                       全屏显示所有种子、节点和 tracker 状态",
+}
+
+func runCtl(cfg *config, args []string) error {
+	fs := newFlagSet("ctl")
+	rpcURL := fs.String("rpc", "http://"+cfg.RPCAddr+"/rpc", "守护进程 API 的 URL")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: p2pin3 %s\n\n操作:\n", commands["ctl"].usage)
+		for _, action := range []string{"add", "list", "info", "stats", "pause", "resume", "remove", "limits", "priority", "queue", "active", "alt", "top"} {
+			fmt.Fprintf(fs.Output(), "  %s\n", ctlCommands[action])
+		}
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	client := daemon.NewClient(*rpcURL)
+	ctx := context.Background()
+	action, args := fs.Arg(0), fs.Args()[1:]
+
+	switch action {
+	case "add":
+		afs := flag.NewFlagSet("ctl add", flag.ContinueOnError)
+		paused := afs.Bool("paused", false, "只添加，不开始下载")
+		err = afs.Parse(args)
+		if err != nil {
+			return err
+		}
+		if afs.NArg() != 1 {
+			return fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+		}
+		var info session.Info
+		if strings.HasPrefix(afs.Arg(0), "magnet:") {
+			info, err = client.AddMagnet(ctx, afs.Arg(0), *paused)
+		} else {
+			var data []byte
+			data, err = ioutil.ReadFile(afs.Arg(0))
+			if err != nil {
+				return err
+			}
+			info, err = client.Add(ctx, data, *paused)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("已添加 #%d %s\n", info.ID, info.Name)
+		return nil
+	case "list":
+		infos, err := client.List(ctx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].QueuePosition < infos[j].QueuePosition })
+		fmt.Printf("%4s  %4s  %-11s  %7s  %10s  %5s  %s\n", "ID", "队列", "状态", "进度", "速度", "节点", "名称")
+		for _, info := range infos {
+			fmt.Printf("%4d  %4d  %-11s  %6.2f%%  %8.2f/s  %5d  %s\n",
+				info.ID, info.QueuePosition, info.Status, info.Percent, info.DownloadRate/1048576, info.Peers, info.Name)
+		}
+		return nil
+	case "stats":
+		st, err := client.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("种子: %d（下载中 %d，做种中 %d，排队 %d，已停止 %d）\n", st.Torrents, st.Downloading, st.Seeding, st.Queued, st.Stopped)
+		fmt.Printf("下载速度: %0.2f MB/s，上传速度: %0.2f MB/s，共下载 %d 字节，共上传 %d 字节\n",
+			st.DownloadRate/1048576, st.UploadRate/1048576, st.Downloaded, st.Uploaded)
+		fmt.Printf("限速: 下载 %s，上传 %s\n", formatLimit(st.DownloadLimit), formatLimit(st.UploadLimit))
+		alt := "未启用"
+		if st.AltSpeed {
+			alt = "已启用"
+		}
+		if st.AltSchedule != nil {
+			alt += "，时段 " + formatSchedule(st.AltSchedule)
+		}
+		fmt.Printf("备用限速: 下载 %s，上传 %s（%s）\n", formatLimit(st.AltDownloadLimit), formatLimit(st.AltUploadLimit), alt)
+		fmt.Printf("连接: %d（发起中 %d），上限 %s（发起中 %s）\n", st.Conns, st.HalfOpen, formatCount(st.MaxConns), formatCount(st.MaxHalfOpen))
+		fmt.Printf("同时下载: 上限 %s，同时做种: 上限 %s\n", formatCount(st.MaxActiveDownloads), formatCount(st.MaxActiveSeeds))
+		return nil
+	case "limits":
+		if len(args) != 2 {
+			return fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+		}
+		down, up, err := parseLimits(args)
+		if err != nil {
+			return err
+		}
+		return client.SetLimits(ctx, down, up)
+	case "queue":
+		if len(args) != 2 {
+			return fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		info, err := client.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		position := info.QueuePosition
+		switch args[1] {
+		case "top":
+			position = 0
+		case "up":
+			if position > 0 {
+				position--
+			}
+		case "down":
+			position++
+		case "bottom":
+			infos, err := client.List(ctx)
+			if err != nil {
+				return err
+			}
+			position = len(infos)
+		default:
+			position, err = strconv.Atoi(args[1])
+			if err != nil {
+				return err
+			}
+		}
+		return client.MoveQueue(ctx, id, position)
+	case "active":
+		if len(args) != 2 {
+			return fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+		}
+		downloads, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		seeds, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return client.SetActiveLimits(ctx, downloads, seeds)
+	case "alt":
+		switch {
+		case len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+			return client.SetAltSpeed(ctx, args[0] == "on")
+		case len(args) == 3 && args[0] == "limits":
+			down, up, err := parseLimits(args[1:])
+			if err != nil {
+				return err
+			}
+			return client.SetAltLimits(ctx, down, up)
+		case len(args) == 2 && args[0] == "schedule":
+			var schedule *session.Schedule
+			if args[1] != "off" {
+				schedule, err = parseSchedule(args[1])
+				if err != nil {
+					return err
+				}
+			}
+			return client.SetAltSchedule(ctx, schedule)
+		}
+		return fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+	case "priority":
+		if len(args) != 3 {
+			return fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		file, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return client.SetFilePriority(ctx, id, file, args[2])
+	case "remove":
+		rfs := flag.NewFlagSet("ctl remove", flag.ContinueOnError)
+		deleteData := rfs.Bool("delete", false, "同时删除数据，只能删除下载目录中的数据")
+		err = rfs.Parse(args)
+		if err != nil {
+			return err
+		}
+		id, err := ctlID(action, rfs.Args())
+		if err != nil {
+			return err
+		}
+		return client.Remove(ctx, id, *deleteData)
+	case "top":
+		ctx, stop := signalContext()
+		defer stop()
+		return runTop(ctx, client)
+	case "info", "pause", "resume":
+		id, err := ctlID(action, args)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case "pause":
+			return client.Pause(ctx, id)
+		case "resume":
+			return client.Resume(ctx, id)
+		}
+		info, err := client.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		printInfo(info)
+		return nil
+	}
+	return fmt.Errorf("未知操作: %s", action)
+}
+
+func ctlID(action string, args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("用法: p2pin3 ctl %s", ctlCommands[action])
+	}
+	return strconv.Atoi(args[0])
+}
+
+func parseLimits(args []string) (down, up int64, err error) {
+	down, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	up, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return down, up, nil
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseSchedule parses a schedule like "08:00-18:00", or
+// "23:00-07:00/mon,tue" to only begin on some days; empty means none
+func parseSchedule(s string) (*session.Schedule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	window, days, _ := strings.Cut(s, "/")
+	begin, end, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("时段 %q 应为 hh:mm-hh:mm[/星期,...]", s)
+	}
+	sc := &session.Schedule{Begin: begin, End: end}
+	if days != "" {
+	days:
+		for _, name := range strings.Split(days, ",") {
+			for d, weekday := range weekdayNames {
+				if strings.EqualFold(name, weekday) {
+					sc.Days = append(sc.Days, time.Weekday(d))
+					continue days
+				}
+			}
+			return nil, fmt.Errorf("未知的星期: %s，应为 %s", name, strings.Join(weekdayNames, ","))
+		}
+	}
+	return sc, sc.Validate()
+}
+
+func formatSchedule(sc *session.Schedule) string {
+	if sc == nil {
+		return ""
+	}
+	s := sc.Begin + "-" + sc.End
+	for i, d := range sc.Days {
+		if i == 0 {
+			s += "/"
+		} else {
+			s += ","
+		}
+		if d >= 0 && int(d) < len(weekdayNames) {
+			s += weekdayNames[d]
+		} else {
+			s += strconv.Itoa(int(d))
+		}
+	}
+	return s
+}
+
+func formatLimit(rate int64) string {
+	if rate == 0 {
+		return "不限"
+	}
+	return fmt.Sprintf("%d 字节/秒", rate)
+}
+
+func formatCount(max int) string {
+	if max == 0 {
+		return "不限"
+	}
+	return strconv.Itoa(max)
+}
+
+func printInfo(info session.Info) {
+	fmt.Printf("#%d %s\n", info.ID, info.Name)
+	fmt.Println("infohash:", info.InfoHash)
+	fmt.Println("位置:    ", info.Path)
+	fmt.Println("状态:    ", info.Status)
+	if info.Error != "" {
+		fmt.Println("错误:    ", info.Error)
+	}
+	fmt.Printf("进度:     %0.2f%%（%d/%d 块）\n", info.Percent, info.PiecesDone, info.PiecesTotal)
+	fmt.Printf("速度:     %0.2f MB/s，剩余 %v，%d 个节点\n", info.DownloadRate/1048576, time.Duration(info.ETA)*time.Second, info.Peers)
+	fmt.Printf("流量:     下载 %d 字节，上传 %d 字节\n", info.Downloaded, info.Uploaded)
+	fmt.Println("添加时间:", info.Added.Format(time.RFC3339))
+	for i, f := range info.Files {
+		fmt.Fprintf(os.Stdout, "  [%d] %-6s %12d  %s\n", i, f.Priority, f.Length, f.Path)
+	}
+}
@@ -0,0 +1,194 @@
+// Command p2pin3 creates, inspects, downloads, seeds and verifies torrents,
+// and runs a tracker.
+//
+// Usage:
+//
+//	p2pin3 [-config file] [-log levels] [-log-json] <command> [flags] [args]
+//
+// Settings are read from a JSON config file, p2pin3.json in the working
+// directory by default, and flags override them.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/hooks"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/session"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// config holds the settings shared by every command
+type config struct {
+	Announce    string // tracker URL written into new torrents
+	PieceLength int
+	TorrentDir  string // where metainfo is saved
+	LibraryPath string
+	DownloadDir string
+	ShareDir    string // seeded automatically by seed, if set
+	InboxDir    string // downloaded automatically by seed, if set
+	SeedAddr    string
+	TrackerAddr string
+	StreamAddr  string // serves downloads over HTTP while they run, if set
+	MetricsAddr string // where seed serves its Prometheus metrics, if set
+	RPCAddr     string // where the daemon serves its API
+	Storage     string // how data is stored: "file", the default, or "mmap"
+
+	// Limits of the daemon, zero meaning unlimited
+	MaxConns           int
+	MaxHalfOpen        int
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+
+	// Rate limits of the daemon in bytes per second, zero meaning
+	// unlimited. The alternate ones apply within AltSchedule, or when
+	// turned on with ctl alt.
+	DownloadLimit    int64
+	UploadLimit      int64
+	AltDownloadLimit int64
+	AltUploadLimit   int64
+	AltSchedule      *session.Schedule
+
+	// Hooks are told about every completed download, by the download,
+	// seed and daemon commands
+	Hooks []hooks.Hook
+
+	// Log sets the log level of every subsystem, or of some of them, like
+	// "info,protocol=debug,seeder=warn"
+	Log     string
+	LogJSON bool // writes the logs as lines of JSON
+}
+
+func defaultConfig() config {
+	return config{
+		Announce:    "http://localhost:8090/announce",
+		PieceLength: 12 * 1024,
+		TorrentDir:  "./have/",
+		LibraryPath: "./hashmap/hashmap.json",
+		DownloadDir: "./downloaded/",
+		SeedAddr:    "localhost:8097",
+		TrackerAddr: ":8090",
+		RPCAddr:     "localhost:9091",
+		MaxConns:    200,
+		MaxHalfOpen: 20,
+	}
+}
+
+const defaultConfigPath = "p2pin3.json"
+
+// loadConfig reads the config file over the defaults. The default file may
+// be missing; a file named with -config may not.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, h := range cfg.Hooks {
+		err = h.Validate()
+		if err != nil {
+			return cfg, fmt.Errorf("%s: hook %d: %w", path, i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// hookRunner returns the runner of the configured hooks, nil if there are none
+func (cfg *config) hookRunner() *hooks.Runner {
+	if len(cfg.Hooks) == 0 {
+		return nil
+	}
+	return &hooks.Runner{Hooks: cfg.Hooks}
+}
+
+type command struct {
+	usage string
+	run   func(cfg *config, args []string) error
+}
+
+var commands map[string]command
+
+// commands are set up in init since their flag sets refer back to them
+func init() {
+	commands = map[string]command{
+		"create":   {"create [flags] <文件或文件夹>    生成种子并登记到种子库", runCreate},
+		"info":     {"info <种子>                      显示种子信息", runInfo},
+		"download": {"download [flags] <种子|magnet>   下载种子", runDownload},
+		"seed":     {"seed [flags]                     为种子库中的种子做种", runSeed},
+		"verify":   {"verify [flags] <种子>            校验已下载的数据", runVerify},
+		"tracker":  {"tracker [flags]                  运行 tracker", runTracker},
+		"daemon":   {"daemon [flags]                   运行管理多个种子的守护进程", runDaemon},
+		"ctl":      {"ctl [flags] <操作> [参数]        通过 API 控制守护进程", runCtl},
+		"replay":   {"replay [flags] <记录>            向做种方重放 -trace 记录的消息并比对回复", runReplay},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "用法: p2pin3 [-config 文件] [-log 级别] [-log-json] <命令> [flags] [参数]\n\n命令:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n运行 p2pin3 <命令> -h 查看命令的 flags\n")
+}
+
+func main() {
+	configPath := flag.String("config", "", "配置文件（默认为 "+defaultConfigPath+"，不存在时使用默认配置）")
+	logLevels := flag.String("log", "", "日志级别，可按子系统设置，如 info,protocol=debug,seeder=warn（debug|info|warn|error|off）")
+	logJSON := flag.Bool("log-json", false, "以 JSON 行输出日志")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "未知命令: %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "读取配置失败:", err)
+		os.Exit(1)
+	}
+	if *logLevels != "" {
+		cfg.Log = *logLevels
+	}
+	cfg.LogJSON = cfg.LogJSON || *logJSON
+	err = logging.Configure(cfg.Log)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "日志配置错误:", err)
+		os.Exit(2)
+	}
+	logging.SetJSON(cfg.LogJSON)
+	err = cmd.run(&cfg, flag.Args()[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "错误:", err)
+		os.Exit(1)
+	}
+}
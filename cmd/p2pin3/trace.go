@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/wiretrace"
+	"time"
+)
+
+const traceUsage = "把与节点交换的每条消息记录到该文件（JSON 行），为空时不记录"
+
+// openTrace creates the trace file named by a -trace flag, nil if none is
+func openTrace(path string) (*wiretrace.Tracer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return wiretrace.Create(path)
+}
+
+func runReplay(cfg *config, args []string) error {
+	fs := newFlagSet("replay")
+	addr := fs.String("addr", "", "做种方的地址（默认为记录中的地址）")
+	timeout := fs.Duration("timeout", 5*time.Minute, "整个重放的超时时间")
+	err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	records, err := wiretrace.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	res, err := wiretrace.Replay(ctx, *addr, records)
+	fmt.Printf("重放了 %d 个连接，发送 %d 条消息，收到 %d 条与记录一致的消息\n", res.Conns, res.Sent, res.Received)
+	if err != nil {
+		return fmt.Errorf("与记录不一致: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/lvkeliang/P2Pin3/daemon"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"github.com/lvkeliang/P2Pin3/tui"
+	"io"
+	"os"
+	"time"
+)
+
+// tuiInterval is how often the full screen view is redrawn
+const tuiInterval = time.Second
+
+// showDownload draws a download on the full screen until the returned
+// function is called. Logs are dropped meanwhile, they would mess up the
+// screen.
+func showDownload(ctx context.Context, t *torrent.TorrentFile, dl *protocol.Torrent, announces *torrent.Tracker) func() {
+	logging.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		screen := &tui.Screen{Out: os.Stdout}
+		screen.Run(ctx, tuiInterval, func() ([]tui.Torrent, error) {
+			view := tui.Torrent{
+				Key:       hex.EncodeToString(t.InfoHash[:]),
+				Name:      t.Name,
+				Status:    "downloading",
+				Progress:  dl.Stats(),
+				NumPieces: len(t.PieceHashes),
+				Pieces:    dl.Have(),
+				Tracker:   announces.Status(),
+			}
+			for _, p := range dl.PeerStats() {
+				view.Peers = append(view.Peers, tui.Peer{
+					Addr:           p.Addr,
+					Rate:           p.Rate,
+					Downloaded:     p.Downloaded,
+					Backlog:        p.Backlog,
+					Choked:         p.Choked,
+					Interested:     p.Interested,
+					PeerInterested: p.PeerInterested,
+				})
+			}
+			return []tui.Torrent{view}, nil
+		})
+	}()
+	return func() {
+		cancel()
+		<-done
+		logging.SetOutput(os.Stderr)
+	}
+}
+
+// runTop shows every torrent of a daemon on the full screen until ctx is done
+func runTop(ctx context.Context, client *daemon.Client) error {
+	screen := &tui.Screen{Out: os.Stdout}
+	return screen.Run(ctx, tuiInterval, func() ([]tui.Torrent, error) {
+		infos, err := client.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var views []tui.Torrent
+		for _, info := range infos {
+			peers, err := client.Peers(ctx, info.ID)
+			if err != nil {
+				return nil, err
+			}
+			view := tui.Torrent{
+				Key:    info.InfoHash,
+				Name:   info.Name,
+				Status: info.Status,
+				Error:  info.Error,
+				Progress: protocol.Progress{
+					PiecesDone:  info.PiecesDone,
+					PiecesTotal: info.PiecesTotal,
+					BytesDone:   info.BytesDone,
+					BytesTotal:  info.BytesTotal,
+					Downloaded:  info.Downloaded,
+					Peers:       info.Peers,
+					Rate:        info.DownloadRate,
+					ETA:         time.Duration(info.ETA) * time.Second,
+				},
+				Uploaded:  info.Uploaded,
+				NumPieces: info.PieceCount,
+				Pieces:    info.Pieces,
+				Tracker:   info.Tracker,
+			}
+			for _, p := range peers {
+				view.Peers = append(view.Peers, tui.Peer{
+					Addr:           p.Addr,
+					Upload:         p.Direction == "upload",
+					Rate:           p.Rate,
+					Downloaded:     p.Downloaded,
+					Uploaded:       p.Uploaded,
+					Backlog:        p.Backlog,
+					Choked:         p.Choked,
+					Interested:     p.Interested,
+					PeerInterested: p.PeerInterested,
+				})
+			}
+			views = append(views, view)
+		}
+		return views, nil
+	})
+}
@@ -0,0 +1,157 @@
+package connlimit
+
+import (
+	"context"
+	"sync"
+)
+
+// Limiter caps the connections of every download and server sharing it:
+// how many are open in total, and how many of them are still being dialed.
+// A nil Limiter, or a limit of zero, lets everything through.
+type Limiter struct {
+	mu          sync.Mutex
+	maxConns    int
+	maxHalfOpen int
+	conns       int // open connections, the half-open ones included
+	halfOpen    int
+	freed       chan struct{} // closed and replaced whenever a slot frees
+}
+
+// Slot is a connection counted by a Limiter. Its methods do nothing on a
+// nil Slot.
+type Slot struct {
+	l        *Limiter
+	halfOpen bool
+	released bool
+}
+
+// New creates a limiter allowing maxConns open connections, maxHalfOpen of
+// them being dialed; zero means unlimited
+func New(maxConns, maxHalfOpen int) *Limiter {
+	l := &Limiter{freed: make(chan struct{})}
+	l.SetLimits(maxConns, maxHalfOpen)
+	return l
+}
+
+// SetLimits changes the limits. Connections above a lowered limit stay
+// open, new ones wait until enough of them close.
+func (l *Limiter) SetLimits(maxConns, maxHalfOpen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxConns < 0 {
+		maxConns = 0
+	}
+	if maxHalfOpen < 0 {
+		maxHalfOpen = 0
+	}
+	l.maxConns, l.maxHalfOpen = maxConns, maxHalfOpen
+	l.wake()
+}
+
+// Limits returns the limits, zero when unlimited
+func (l *Limiter) Limits() (maxConns, maxHalfOpen int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxConns, l.maxHalfOpen
+}
+
+// Counts returns how many connections are open and how many of them are
+// being dialed
+func (l *Limiter) Counts() (conns, halfOpen int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns, l.halfOpen
+}
+
+// Dial waits until an outgoing connection may be dialed and counts it as
+// half-open. Call Established once the handshake is done and Release once
+// the connection closes.
+func (l *Limiter) Dial(ctx context.Context) (*Slot, error) {
+	if l == nil {
+		return nil, nil
+	}
+	for {
+		l.mu.Lock()
+		if l.fits(l.maxConns, l.conns) && l.fits(l.maxHalfOpen, l.halfOpen) {
+			l.conns++
+			l.halfOpen++
+			l.mu.Unlock()
+			return &Slot{l: l, halfOpen: true}, nil
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Accept counts an incoming connection, reporting false when there is no
+// room for it; incoming connections are refused rather than kept waiting
+func (l *Limiter) Accept() (*Slot, bool) {
+	if l == nil {
+		return nil, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.fits(l.maxConns, l.conns) {
+		return nil, false
+	}
+	l.conns++
+	return &Slot{l: l}, true
+}
+
+func (l *Limiter) fits(max, n int) bool {
+	return max == 0 || n < max
+}
+
+// wake tells the waiting dialers that a slot may have freed. The caller
+// holds l.mu.
+func (l *Limiter) wake() {
+	if l.freed != nil {
+		close(l.freed)
+	}
+	l.freed = make(chan struct{})
+}
+
+// Established counts a dialed connection as open rather than half-open
+func (s *Slot) Established() {
+	if s == nil {
+		return
+	}
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	if s.halfOpen && !s.released {
+		s.halfOpen = false
+		s.l.halfOpen--
+		s.l.wake()
+	}
+}
+
+// Release frees the slot once the connection is closed or failed. Releasing
+// twice does nothing.
+func (s *Slot) Release() {
+	if s == nil {
+		return
+	}
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.l.conns--
+	if s.halfOpen {
+		s.l.halfOpen--
+	}
+	s.l.wake()
+}
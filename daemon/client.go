@@ -0,0 +1,183 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/session"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client calls the JSON-RPC API of a daemon
+type Client struct {
+	URL        string // for example http://localhost:9091/rpc
+	HTTPClient *http.Client
+
+	id        atomic.Int64
+	mu        sync.Mutex
+	sessionID string // sent in SessionIDHeader, learnt from the daemon
+}
+
+// NewClient creates a client for the API at url
+func NewClient(url string) *Client {
+	return &Client{URL: url, HTTPClient: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Call calls a method and decodes its result into result, unless it is nil.
+// Errors returned by the daemon are *Error.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	id, _ := json.Marshal(c.id.Add(1))
+	body, err := json.Marshal(request{JSONRPC: "2.0", Method: method, Params: rawParams, ID: id})
+	if err != nil {
+		return err
+	}
+	resp, err := c.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict && resp.Header.Get(SessionIDHeader) != "" {
+		// The daemon told the session id to send; try again with it
+		resp.Body.Close()
+		c.mu.Lock()
+		c.sessionID = resp.Header.Get(SessionIDHeader)
+		c.mu.Unlock()
+		resp, err = c.post(ctx, body)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", c.URL, resp.Status)
+	}
+
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+func (c *Client) post(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.mu.Lock()
+	req.Header.Set(SessionIDHeader, c.sessionID)
+	c.mu.Unlock()
+	return c.HTTPClient.Do(req)
+}
+
+// Add adds a torrent from its metainfo, as saved by the torrent package
+func (c *Client) Add(ctx context.Context, metainfo []byte, paused bool) (session.Info, error) {
+	var info session.Info
+	err := c.Call(ctx, "add", AddParams{Metainfo: metainfo, Paused: paused}, &info)
+	return info, err
+}
+
+// AddMagnet adds a torrent from a magnet link the daemon can resolve
+func (c *Client) AddMagnet(ctx context.Context, magnet string, paused bool) (session.Info, error) {
+	var info session.Info
+	err := c.Call(ctx, "add", AddParams{Magnet: magnet, Paused: paused}, &info)
+	return info, err
+}
+
+// Remove removes a torrent, deleting its data if deleteData is set
+func (c *Client) Remove(ctx context.Context, id int, deleteData bool) error {
+	return c.Call(ctx, "remove", RemoveParams{ID: id, DeleteData: deleteData}, nil)
+}
+
+// Pause stops a download
+func (c *Client) Pause(ctx context.Context, id int) error {
+	return c.Call(ctx, "pause", IDParams{ID: id}, nil)
+}
+
+// Resume restarts a stopped download
+func (c *Client) Resume(ctx context.Context, id int) error {
+	return c.Call(ctx, "resume", IDParams{ID: id}, nil)
+}
+
+// Get returns a torrent
+func (c *Client) Get(ctx context.Context, id int) (session.Info, error) {
+	var info session.Info
+	err := c.Call(ctx, "get", IDParams{ID: id}, &info)
+	return info, err
+}
+
+// List returns every torrent
+func (c *Client) List(ctx context.Context) ([]session.Info, error) {
+	var infos []session.Info
+	err := c.Call(ctx, "list", nil, &infos)
+	return infos, err
+}
+
+// Peers returns the connections of a torrent
+func (c *Client) Peers(ctx context.Context, id int) ([]session.PeerInfo, error) {
+	var peers []session.PeerInfo
+	err := c.Call(ctx, "peers", IDParams{ID: id}, &peers)
+	return peers, err
+}
+
+// Stats returns the totals of the session
+func (c *Client) Stats(ctx context.Context) (session.Stats, error) {
+	var stats session.Stats
+	err := c.Call(ctx, "stats", nil, &stats)
+	return stats, err
+}
+
+// SetLimits changes the rate limits, in bytes per second; zero removes one
+func (c *Client) SetLimits(ctx context.Context, download, upload int64) error {
+	return c.Call(ctx, "setLimits", LimitsParams{Download: download, Upload: upload}, nil)
+}
+
+// SetFilePriority changes the priority of a file: "normal", "high" or "skip"
+func (c *Client) SetFilePriority(ctx context.Context, id, file int, priority string) error {
+	return c.Call(ctx, "setFilePriority", FilePriorityParams{ID: id, File: file, Priority: priority}, nil)
+}
+
+// MoveQueue moves a torrent to a position in the queue, from 0
+func (c *Client) MoveQueue(ctx context.Context, id, position int) error {
+	return c.Call(ctx, "moveQueue", QueueParams{ID: id, Position: position}, nil)
+}
+
+// SetActiveLimits changes how many torrents may download and seed at once;
+// zero removes a limit
+func (c *Client) SetActiveLimits(ctx context.Context, downloads, seeds int) error {
+	return c.Call(ctx, "setActiveLimits", ActiveLimitsParams{Downloads: downloads, Seeds: seeds}, nil)
+}
+
+// SetAltLimits changes the alternate rate limits, in bytes per second
+func (c *Client) SetAltLimits(ctx context.Context, download, upload int64) error {
+	return c.Call(ctx, "setAltLimits", LimitsParams{Download: download, Upload: upload}, nil)
+}
+
+// SetAltSpeed turns the alternate rate limits on or off
+func (c *Client) SetAltSpeed(ctx context.Context, on bool) error {
+	return c.Call(ctx, "setAltSpeed", AltSpeedParams{On: on}, nil)
+}
+
+// SetAltSchedule changes when the alternate rate limits turn on by
+// themselves; nil removes the schedule
+func (c *Client) SetAltSchedule(ctx context.Context, sc *session.Schedule) error {
+	return c.Call(ctx, "setAltSchedule", AltScheduleParams{Schedule: sc}, nil)
+}
@@ -0,0 +1,417 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/metrics"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/session"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"mime"
+	"net/http"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeNotFound is returned for an unknown torrent ID
+	CodeNotFound = -32000
+)
+
+// Error is a JSON-RPC error
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// AddParams are the parameters of "add". Metainfo holds a torrent saved by
+// the torrent package; Magnet is used when it is empty.
+type AddParams struct {
+	Metainfo json.RawMessage `json:"metainfo,omitempty"`
+	Magnet   string          `json:"magnet,omitempty"`
+	Paused   bool            `json:"paused,omitempty"`
+}
+
+// IDParams are the parameters of the methods acting on one torrent
+type IDParams struct {
+	ID int `json:"id"`
+}
+
+// RemoveParams are the parameters of "remove"
+type RemoveParams struct {
+	ID         int  `json:"id"`
+	DeleteData bool `json:"deleteData,omitempty"`
+}
+
+// LimitsParams are the parameters of "setLimits", in bytes per second;
+// zero removes a limit
+type LimitsParams struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+// QueueParams are the parameters of "moveQueue"; Position counts from 0
+type QueueParams struct {
+	ID       int `json:"id"`
+	Position int `json:"position"`
+}
+
+// ActiveLimitsParams are the parameters of "setActiveLimits", how many
+// torrents may download and seed at once; zero removes a limit
+type ActiveLimitsParams struct {
+	Downloads int `json:"downloads"`
+	Seeds     int `json:"seeds"`
+}
+
+// AltSpeedParams are the parameters of "setAltSpeed", which turns the
+// alternate limits on or off by hand
+type AltSpeedParams struct {
+	On bool `json:"on"`
+}
+
+// AltScheduleParams are the parameters of "setAltSchedule"; a null
+// schedule removes it
+type AltScheduleParams struct {
+	Schedule *session.Schedule `json:"schedule"`
+}
+
+// FilePriorityParams are the parameters of "setFilePriority"; Priority is
+// "normal", "high" or "skip"
+type FilePriorityParams struct {
+	ID       int    `json:"id"`
+	File     int    `json:"file"`
+	Priority string `json:"priority"`
+}
+
+// Server exposes a session over HTTP. JSON-RPC 2.0 requests are posted to
+// /rpc; the methods are add, remove, pause, resume, get, list, peers,
+// stats, setLimits, setFilePriority, moveQueue, setActiveLimits,
+// setAltLimits, setAltSpeed and setAltSchedule. /transmission/rpc speaks
+// the Transmission RPC protocol so existing Transmission clients can drive
+// the session. /metrics exposes Prometheus metrics, and the web UI is
+// served from /.
+//
+// So that other web pages cannot make a browser call the APIs, both take
+// only requests carrying the session id in SessionIDHeader, as Transmission
+// does: a request without it is answered 409 Conflict with the id in the
+// header, to be sent again. /rpc also takes only application/json.
+type Server struct {
+	Session *session.Session
+
+	mux       *http.ServeMux
+	sessionID string
+	methods   map[string]func(params json.RawMessage) (interface{}, error)
+}
+
+// NewServer creates the HTTP server of a session
+func NewServer(s *session.Session) *Server {
+	id := make([]byte, 24)
+	rand.Read(id)
+	d := &Server{Session: s, mux: http.NewServeMux(), sessionID: base64.RawURLEncoding.EncodeToString(id)}
+	d.methods = map[string]func(json.RawMessage) (interface{}, error){
+		"add":             d.add,
+		"remove":          d.remove,
+		"pause":           d.pause,
+		"resume":          d.resume,
+		"get":             d.get,
+		"list":            d.list,
+		"peers":           d.peers,
+		"stats":           d.stats,
+		"setLimits":       d.setLimits,
+		"setFilePriority": d.setFilePriority,
+		"moveQueue":       d.moveQueue,
+		"setActiveLimits": d.setActiveLimits,
+		"setAltLimits":    d.setAltLimits,
+		"setAltSpeed":     d.setAltSpeed,
+		"setAltSchedule":  d.setAltSchedule,
+	}
+	d.mux.HandleFunc("/rpc", d.serveRPC)
+	d.mux.Handle("/transmission/rpc", newTransmission(s, d.sessionID))
+	d.mux.Handle("/metrics", metrics.Handler(s.WriteMetrics))
+	d.mux.Handle("/", webHandler())
+	return d
+}
+
+func (d *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+func (d *Server) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		http.Error(w, "JSON-RPC requests must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Header.Get(SessionIDHeader) != d.sessionID {
+		w.Header().Set(SessionIDHeader, d.sessionID)
+		http.Error(w, "invalid "+SessionIDHeader+" header", http.StatusConflict)
+		return
+	}
+	var req request
+	resp := response{JSONRPC: "2.0"}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	switch {
+	case err != nil:
+		resp.Error = &Error{Code: CodeParseError, Message: err.Error()}
+	case req.JSONRPC != "2.0" || req.Method == "":
+		resp.ID = req.ID
+		resp.Error = &Error{Code: CodeInvalidRequest, Message: "not a JSON-RPC 2.0 request"}
+	default:
+		resp.ID = req.ID
+		resp.Result, err = d.call(req.Method, req.Params)
+		if err != nil {
+			resp.Error = toError(err)
+			resp.Result = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (d *Server) call(method string, params json.RawMessage) (interface{}, error) {
+	fn, ok := d.methods[method]
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: "no method " + method}
+	}
+	return fn(params)
+}
+
+func toError(err error) *Error {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	if errors.Is(err, session.ErrNotFound) {
+		return &Error{Code: CodeNotFound, Message: err.Error()}
+	}
+	return &Error{Code: CodeInternalError, Message: err.Error()}
+}
+
+// decode unmarshals params into v, missing params leaving it untouched
+func decode(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (d *Server) add(params json.RawMessage) (interface{}, error) {
+	var p AddParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	var t *session.Torrent
+	switch {
+	case len(p.Metainfo) > 0:
+		var tf torrent.TorrentFile
+		err = json.Unmarshal(p.Metainfo, &tf)
+		if err != nil || len(tf.PieceHashes) == 0 {
+			return nil, &Error{Code: CodeInvalidParams, Message: "bad metainfo"}
+		}
+		err = tf.Validate()
+		if err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+		t, err = d.Session.Add(&tf, p.Paused)
+	case p.Magnet != "":
+		t, err = d.Session.AddMagnet(p.Magnet, p.Paused)
+	default:
+		return nil, &Error{Code: CodeInvalidParams, Message: "metainfo or magnet is required"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.Session.Info(t), nil
+}
+
+func (d *Server) remove(params json.RawMessage) (interface{}, error) {
+	var p RemoveParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	return true, d.Session.Remove(p.ID, p.DeleteData)
+}
+
+func (d *Server) pause(params json.RawMessage) (interface{}, error) {
+	var p IDParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	return true, d.Session.Stop(p.ID)
+}
+
+func (d *Server) resume(params json.RawMessage) (interface{}, error) {
+	var p IDParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	return true, d.Session.Start(p.ID)
+}
+
+func (d *Server) get(params json.RawMessage) (interface{}, error) {
+	var p IDParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	t, err := d.Session.Get(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return d.Session.Info(t), nil
+}
+
+func (d *Server) list(json.RawMessage) (interface{}, error) {
+	infos := []session.Info{}
+	for _, t := range d.Session.Torrents() {
+		infos = append(infos, d.Session.Info(t))
+	}
+	return infos, nil
+}
+
+func (d *Server) peers(params json.RawMessage) (interface{}, error) {
+	var p IDParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	t, err := d.Session.Get(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	peers := d.Session.Peers(t)
+	if peers == nil {
+		peers = []session.PeerInfo{}
+	}
+	return peers, nil
+}
+
+func (d *Server) stats(json.RawMessage) (interface{}, error) {
+	return d.Session.Stats(), nil
+}
+
+func (d *Server) setLimits(params json.RawMessage) (interface{}, error) {
+	var p LimitsParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Download < 0 || p.Upload < 0 {
+		return nil, &Error{Code: CodeInvalidParams, Message: "limits cannot be negative"}
+	}
+	d.Session.SetLimits(p.Download, p.Upload)
+	return d.Session.Stats(), nil
+}
+
+func (d *Server) setFilePriority(params json.RawMessage) (interface{}, error) {
+	var p FilePriorityParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	prio, err := protocol.ParseFilePriority(p.Priority)
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return true, d.Session.SetFilePriority(p.ID, p.File, prio)
+}
+
+func (d *Server) moveQueue(params json.RawMessage) (interface{}, error) {
+	var p QueueParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Position < 0 {
+		return nil, &Error{Code: CodeInvalidParams, Message: "queue position cannot be negative"}
+	}
+	return true, d.Session.MoveQueue(p.ID, p.Position)
+}
+
+func (d *Server) setActiveLimits(params json.RawMessage) (interface{}, error) {
+	var p ActiveLimitsParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Downloads < 0 || p.Seeds < 0 {
+		return nil, &Error{Code: CodeInvalidParams, Message: "limits cannot be negative"}
+	}
+	d.Session.SetActiveLimits(p.Downloads, p.Seeds)
+	return d.Session.Stats(), nil
+}
+
+func (d *Server) setAltLimits(params json.RawMessage) (interface{}, error) {
+	var p LimitsParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Download < 0 || p.Upload < 0 {
+		return nil, &Error{Code: CodeInvalidParams, Message: "limits cannot be negative"}
+	}
+	d.Session.SetAltLimits(p.Download, p.Upload)
+	return d.Session.Stats(), nil
+}
+
+func (d *Server) setAltSpeed(params json.RawMessage) (interface{}, error) {
+	var p AltSpeedParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	d.Session.SetAltSpeed(p.On)
+	return d.Session.Stats(), nil
+}
+
+func (d *Server) setAltSchedule(params json.RawMessage) (interface{}, error) {
+	var p AltScheduleParams
+	err := decode(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	err = d.Session.SetAltSchedule(p.Schedule)
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return d.Session.Stats(), nil
+}
@@ -0,0 +1,704 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/session"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SessionIDHeader carries the token clients of the APIs must send back to
+// prove they can read responses, which protects against CSRF
+const SessionIDHeader = "X-Transmission-Session-Id"
+
+// Transmission status codes
+const (
+	trStopped     = 0
+	trQueued      = 3
+	trDownloading = 4
+	trSeedQueued  = 5
+	trSeeding     = 6
+)
+
+type trRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type trResponse struct {
+	Result    string          `json:"result"`
+	Arguments interface{}     `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// transmission answers the subset of the Transmission RPC protocol that
+// frontends need to list and drive torrents, mapped onto the session
+type transmission struct {
+	session   *session.Session
+	sessionID string
+	methods   map[string]func(args json.RawMessage) (interface{}, error)
+}
+
+func newTransmission(s *session.Session, sessionID string) *transmission {
+	tr := &transmission{session: s, sessionID: sessionID}
+	tr.methods = map[string]func(json.RawMessage) (interface{}, error){
+		"session-get":       tr.sessionGet,
+		"session-set":       tr.sessionSet,
+		"session-stats":     tr.sessionStats,
+		"torrent-add":       tr.torrentAdd,
+		"torrent-get":       tr.torrentGet,
+		"torrent-set":       tr.torrentSet,
+		"torrent-start":     tr.torrentStart,
+		"torrent-start-now": tr.torrentStart,
+		"torrent-stop":      tr.torrentStop,
+		"torrent-remove":    tr.torrentRemove,
+		"queue-move-top":    tr.queueMove(moveTop),
+		"queue-move-up":     tr.queueMove(moveUp),
+		"queue-move-down":   tr.queueMove(moveDown),
+		"queue-move-bottom": tr.queueMove(moveBottom),
+	}
+	return tr
+}
+
+func (tr *transmission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(SessionIDHeader) != tr.sessionID {
+		w.Header().Set(SessionIDHeader, tr.sessionID)
+		http.Error(w, "<h1>409: Conflict</h1><p>Your request had an invalid session-id header.</p>", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "requests must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req trRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := trResponse{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	fn, ok := tr.methods[req.Method]
+	if !ok {
+		resp.Result = "method name not recognized"
+	} else {
+		args, err := fn(req.Arguments)
+		if err != nil {
+			resp.Result = err.Error()
+		} else if args != nil {
+			resp.Arguments = args
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decodeArgs unmarshals arguments, which may be missing
+func decodeArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 || string(args) == "null" {
+		return nil
+	}
+	return json.Unmarshal(args, v)
+}
+
+// kbps converts a limit in bytes per second to the KB/s Transmission uses
+func kbps(rate int64) int64 {
+	return rate / 1000
+}
+
+func (tr *transmission) sessionGet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Fields []string `json:"fields"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return nil, err
+	}
+	st := tr.session.Stats()
+	var begin, end, days int
+	if sc := st.AltSchedule; sc != nil {
+		begin, end, days = minutes(sc.Begin), minutes(sc.End), dayMask(sc.Days)
+	}
+	all := map[string]interface{}{
+		"version":                  "3.00 (P2Pin3)",
+		"rpc-version":              17,
+		"rpc-version-minimum":      14,
+		"session-id":               tr.sessionID,
+		"download-dir":             tr.session.DownloadDir(),
+		"speed-limit-down":         kbps(st.DownloadLimit),
+		"speed-limit-down-enabled": st.DownloadLimit > 0,
+		"speed-limit-up":           kbps(st.UploadLimit),
+		"speed-limit-up-enabled":   st.UploadLimit > 0,
+		"alt-speed-down":           kbps(st.AltDownloadLimit),
+		"alt-speed-up":             kbps(st.AltUploadLimit),
+		"alt-speed-enabled":        st.AltSpeedOn,
+		"alt-speed-time-enabled":   st.AltSchedule != nil,
+		"alt-speed-time-begin":     begin,
+		"alt-speed-time-end":       end,
+		"alt-speed-time-day":       days,
+		"download-queue-enabled":   st.MaxActiveDownloads > 0,
+		"download-queue-size":      st.MaxActiveDownloads,
+		"seed-queue-enabled":       st.MaxActiveSeeds > 0,
+		"seed-queue-size":          st.MaxActiveSeeds,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  1000,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	return pick(all, req.Fields), nil
+}
+
+func (tr *transmission) sessionSet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Down        *int64 `json:"speed-limit-down"`
+		DownEnabled *bool  `json:"speed-limit-down-enabled"`
+		Up          *int64 `json:"speed-limit-up"`
+		UpEnabled   *bool  `json:"speed-limit-up-enabled"`
+
+		AltDown     *int64 `json:"alt-speed-down"`
+		AltUp       *int64 `json:"alt-speed-up"`
+		AltEnabled  *bool  `json:"alt-speed-enabled"`
+		TimeEnabled *bool  `json:"alt-speed-time-enabled"`
+		TimeBegin   *int   `json:"alt-speed-time-begin"`
+		TimeEnd     *int   `json:"alt-speed-time-end"`
+		TimeDay     *int   `json:"alt-speed-time-day"`
+
+		DownloadQueueEnabled *bool `json:"download-queue-enabled"`
+		DownloadQueueSize    *int  `json:"download-queue-size"`
+		SeedQueueEnabled     *bool `json:"seed-queue-enabled"`
+		SeedQueueSize        *int  `json:"seed-queue-size"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return nil, err
+	}
+	st := tr.session.Stats()
+
+	// Transmission keeps a limit while it is disabled; the session only
+	// has a rate, zero meaning disabled, so the last value set is kept here
+	down := applyLimit(st.DownloadLimit, req.Down, req.DownEnabled)
+	up := applyLimit(st.UploadLimit, req.Up, req.UpEnabled)
+	tr.session.SetLimits(down, up)
+
+	altDown, altUp := st.AltDownloadLimit, st.AltUploadLimit
+	if req.AltDown != nil {
+		altDown = *req.AltDown * 1000
+	}
+	if req.AltUp != nil {
+		altUp = *req.AltUp * 1000
+	}
+	tr.session.SetAltLimits(altDown, altUp)
+	if req.AltEnabled != nil {
+		tr.session.SetAltSpeed(*req.AltEnabled)
+	}
+
+	// Likewise the schedule is dropped when disabled, so changing its times
+	// only counts while it is enabled
+	enabled := st.AltSchedule != nil
+	if req.TimeEnabled != nil {
+		enabled = *req.TimeEnabled
+	}
+	if !enabled {
+		tr.session.SetAltSchedule(nil)
+	} else if req.TimeEnabled != nil || req.TimeBegin != nil || req.TimeEnd != nil || req.TimeDay != nil {
+		sc := session.Schedule{Begin: "09:00", End: "17:00"}
+		if st.AltSchedule != nil {
+			sc = *st.AltSchedule
+		}
+		if req.TimeBegin != nil {
+			sc.Begin = clock(*req.TimeBegin)
+		}
+		if req.TimeEnd != nil {
+			sc.End = clock(*req.TimeEnd)
+		}
+		if req.TimeDay != nil {
+			sc.Days = weekdays(*req.TimeDay)
+		}
+		err = tr.session.SetAltSchedule(&sc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	downloads := applyQueue(st.MaxActiveDownloads, req.DownloadQueueSize, req.DownloadQueueEnabled)
+	seeds := applyQueue(st.MaxActiveSeeds, req.SeedQueueSize, req.SeedQueueEnabled)
+	tr.session.SetActiveLimits(downloads, seeds)
+	return nil, nil
+}
+
+func applyQueue(size int, newSize *int, enabled *bool) int {
+	if newSize != nil && (enabled == nil || *enabled) && (size > 0 || enabled != nil) {
+		size = *newSize
+	}
+	if enabled != nil && !*enabled {
+		size = 0
+	}
+	return size
+}
+
+// minutes converts a time of day like "08:30" to minutes since midnight
+func minutes(clock string) int {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// clock converts minutes since midnight to a time of day like "08:30"
+func clock(minutes int) string {
+	minutes = (minutes%(24*60) + 24*60) % (24 * 60)
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// dayMask converts weekdays to the bitmask Transmission uses, Sunday being
+// 1 and Saturday 64; no weekdays means every day
+func dayMask(days []time.Weekday) int {
+	if len(days) == 0 {
+		return 127
+	}
+	mask := 0
+	for _, d := range days {
+		mask |= 1 << d
+	}
+	return mask
+}
+
+func weekdays(mask int) []time.Weekday {
+	if mask&127 == 127 {
+		return nil
+	}
+	var days []time.Weekday
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if mask&(1<<d) != 0 {
+			days = append(days, d)
+		}
+	}
+	return days
+}
+
+func applyLimit(rate int64, kb *int64, enabled *bool) int64 {
+	if kb != nil && (enabled == nil || *enabled) && (rate > 0 || enabled != nil) {
+		rate = *kb * 1000
+	}
+	if enabled != nil && !*enabled {
+		rate = 0
+	}
+	return rate
+}
+
+func (tr *transmission) sessionStats(json.RawMessage) (interface{}, error) {
+	st := tr.session.Stats()
+	return map[string]interface{}{
+		"activeTorrentCount": st.Downloading + st.Seeding,
+		"pausedTorrentCount": st.Stopped,
+		"torrentCount":       st.Torrents,
+		"downloadSpeed":      int64(st.DownloadRate),
+		"uploadSpeed":        int64(st.UploadRate),
+		"cumulative-stats": map[string]interface{}{
+			"downloadedBytes": st.Downloaded,
+			"uploadedBytes":   st.Uploaded,
+		},
+		"current-stats": map[string]interface{}{
+			"downloadedBytes": st.Downloaded,
+			"uploadedBytes":   st.Uploaded,
+		},
+	}, nil
+}
+
+func (tr *transmission) torrentAdd(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Filename string `json:"filename"`
+		Metainfo string `json:"metainfo"` // base64
+		Paused   bool   `json:"paused"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	var t *session.Torrent
+	switch {
+	case req.Metainfo != "":
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(req.Metainfo)
+		if err != nil {
+			return nil, err
+		}
+		t, err = tr.addMetainfo(data, req.Paused)
+	case strings.HasPrefix(req.Filename, "magnet:"):
+		t, err = tr.session.AddMagnet(req.Filename, req.Paused)
+	case req.Filename != "":
+		// A path would have the daemon read any file of its host for
+		// whoever calls; clients upload .torrent files as metainfo
+		return nil, errors.New("filename must be a magnet link, send torrent files as metainfo")
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+
+	if errors.Is(err, session.ErrExists) {
+		return map[string]interface{}{"torrent-duplicate": tr.added(err, req.Metainfo, req.Filename)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"torrent-added": addedInfo(tr.session.Info(t))}, nil
+}
+
+// addMetainfo adds a torrent from a bencoded .torrent file, or from the
+// JSON metainfo saved by the torrent package
+func (tr *transmission) addMetainfo(data []byte, paused bool) (*session.Torrent, error) {
+	tf, err := torrent.ParseMetainfo(data)
+	if err == nil && len(tf.PieceHashes) == 0 {
+		err = errors.New("no pieces")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid or corrupt torrent file: %w", err)
+	}
+	return tr.session.Add(&tf, paused)
+}
+
+// added describes the torrent that a duplicate add refers to
+func (tr *transmission) added(err error, metainfo, filename string) interface{} {
+	var infoHash [20]byte
+	switch {
+	case metainfo != "":
+		data, _ := base64.StdEncoding.DecodeString(metainfo)
+		tf, _ := torrent.ParseMetainfo(data)
+		infoHash = tf.InfoHash
+	default:
+		infoHash, _, _ = torrent.ParseMagnet(filename)
+	}
+	t := tr.session.Lookup(infoHash)
+	if t == nil {
+		return struct{}{}
+	}
+	return addedInfo(tr.session.Info(t))
+}
+
+func addedInfo(info session.Info) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         info.ID,
+		"name":       info.Name,
+		"hashString": info.InfoHash,
+	}
+}
+
+// torrents resolves the "ids" argument: a single ID, a list of IDs and
+// hash strings, or every torrent when it is missing
+func (tr *transmission) torrents(raw json.RawMessage) ([]*session.Torrent, error) {
+	all := tr.session.Torrents()
+	if len(raw) == 0 || string(raw) == "null" {
+		return all, nil
+	}
+	var one int
+	if json.Unmarshal(raw, &one) == nil {
+		raw = json.RawMessage(fmt.Sprintf("[%d]", one))
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		if s == "recently-active" {
+			return all, nil
+		}
+		raw, _ = json.Marshal([]string{s})
+	}
+	var ids []interface{}
+	err := json.Unmarshal(raw, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ids: %w", err)
+	}
+
+	var torrents []*session.Torrent
+	for _, t := range all {
+		for _, id := range ids {
+			switch id := id.(type) {
+			case float64:
+				if int(id) == t.ID {
+					torrents = append(torrents, t)
+				}
+			case string:
+				if strings.EqualFold(id, hex.EncodeToString(t.File.InfoHash[:])) {
+					torrents = append(torrents, t)
+				}
+			}
+		}
+	}
+	return torrents, nil
+}
+
+func (tr *transmission) torrentGet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		IDs    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return nil, err
+	}
+	torrents, err := tr.torrents(req.IDs)
+	if err != nil {
+		return nil, err
+	}
+	list := []interface{}{}
+	for _, t := range torrents {
+		list = append(list, pick(tr.fields(t), req.Fields))
+	}
+	return map[string]interface{}{"torrents": list}, nil
+}
+
+// fields returns every field of a torrent that torrent-get knows
+func (tr *transmission) fields(t *session.Torrent) map[string]interface{} {
+	info := tr.session.Info(t)
+	status := trStopped
+	switch info.Status {
+	case session.StatusDownloading.String():
+		status = trDownloading
+	case session.StatusSeeding.String():
+		status = trSeeding
+	case session.StatusQueued.String():
+		status = trQueued
+	case session.StatusSeedQueued.String():
+		status = trSeedQueued
+	}
+	complete := status == trSeeding || status == trSeedQueued
+	eta := info.ETA
+	if eta == 0 && !complete {
+		eta = -1
+	}
+	errCode := 0
+	if info.Error != "" {
+		errCode = 3 // local error
+	}
+	var files, fileStats []interface{}
+	for _, f := range info.Files {
+		files = append(files, map[string]interface{}{
+			"name":           f.Path,
+			"length":         f.Length,
+			"bytesCompleted": f.BytesDone,
+		})
+		prio := 0
+		if f.Priority == protocol.PriorityHigh.String() {
+			prio = 1
+		}
+		fileStats = append(fileStats, map[string]interface{}{
+			"bytesCompleted": f.BytesDone,
+			"wanted":         f.Priority != protocol.PrioritySkip.String(),
+			"priority":       prio,
+		})
+	}
+	ratio := -1.0
+	if info.Downloaded > 0 {
+		ratio = float64(info.Uploaded) / float64(info.Downloaded)
+	}
+	percent := info.Percent / 100
+
+	return map[string]interface{}{
+		"id":             info.ID,
+		"name":           info.Name,
+		"hashString":     info.InfoHash,
+		"status":         status,
+		"error":          errCode,
+		"errorString":    info.Error,
+		"percentDone":    percent,
+		"rateDownload":   int64(info.DownloadRate),
+		"rateUpload":     int64(info.UploadRate),
+		"eta":            eta,
+		"totalSize":      info.Length,
+		"sizeWhenDone":   info.BytesTotal,
+		"leftUntilDone":  info.BytesTotal - info.BytesDone,
+		"haveValid":      info.BytesDone,
+		"downloadedEver": info.Downloaded,
+		"uploadedEver":   info.Uploaded,
+		"uploadRatio":    ratio,
+		"addedDate":      info.Added.Unix(),
+		"downloadDir":    filepath.Dir(info.Path),
+		"peersConnected": info.Peers,
+		"pieceCount":     len(t.File.PieceHashes),
+		"pieceSize":      t.File.PieceLength,
+		"queuePosition":  info.QueuePosition,
+		"isFinished":     complete,
+		"files":          files,
+		"fileStats":      fileStats,
+	}
+}
+
+// pick keeps the requested fields, or every field when none is requested
+func pick(all map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return all
+	}
+	picked := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			picked[f] = v
+		}
+	}
+	return picked
+}
+
+func (tr *transmission) torrentSet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		IDs      json.RawMessage `json:"ids"`
+		Wanted   []int           `json:"files-wanted"`
+		Unwanted []int           `json:"files-unwanted"`
+		High     []int           `json:"priority-high"`
+		Normal   []int           `json:"priority-normal"`
+		Low      []int           `json:"priority-low"`
+		Position *int            `json:"queuePosition"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return nil, err
+	}
+	torrents, err := tr.torrents(req.IDs)
+	if err != nil {
+		return nil, err
+	}
+	// There is no low priority; low files are downloaded like normal ones
+	changes := []struct {
+		files    []int
+		priority protocol.FilePriority
+	}{
+		{req.Wanted, protocol.PriorityNormal},
+		{req.Normal, protocol.PriorityNormal},
+		{req.Low, protocol.PriorityNormal},
+		{req.High, protocol.PriorityHigh},
+		{req.Unwanted, protocol.PrioritySkip},
+	}
+	for _, t := range torrents {
+		if req.Position != nil {
+			err = tr.session.MoveQueue(t.ID, *req.Position)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, c := range changes {
+			for _, file := range c.files {
+				err = tr.session.SetFilePriority(t.ID, file, c.priority)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (tr *transmission) torrentStart(args json.RawMessage) (interface{}, error) {
+	return nil, tr.each(args, tr.session.Start)
+}
+
+func (tr *transmission) torrentStop(args json.RawMessage) (interface{}, error) {
+	return nil, tr.each(args, tr.session.Stop)
+}
+
+func (tr *transmission) torrentRemove(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		DeleteData bool `json:"delete-local-data"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return nil, err
+	}
+	return nil, tr.each(args, func(id int) error {
+		return tr.session.Remove(id, req.DeleteData)
+	})
+}
+
+// each calls fn with the ID of every torrent named by the "ids" argument
+func (tr *transmission) each(args json.RawMessage, fn func(id int) error) error {
+	var req struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	err := decodeArgs(args, &req)
+	if err != nil {
+		return err
+	}
+	torrents, err := tr.torrents(req.IDs)
+	if err != nil {
+		return err
+	}
+	for _, t := range torrents {
+		err = fn(t.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Directions of the queue-move methods
+const (
+	moveTop = iota
+	moveUp
+	moveDown
+	moveBottom
+)
+
+// queueMove returns the method moving the torrents named by the "ids"
+// argument in the queue, keeping their order between them
+func (tr *transmission) queueMove(direction int) func(json.RawMessage) (interface{}, error) {
+	return func(args json.RawMessage) (interface{}, error) {
+		var req struct {
+			IDs json.RawMessage `json:"ids"`
+		}
+		err := decodeArgs(args, &req)
+		if err != nil {
+			return nil, err
+		}
+		torrents, err := tr.torrents(req.IDs)
+		if err != nil {
+			return nil, err
+		}
+		positions := make(map[*session.Torrent]int, len(torrents))
+		for _, t := range torrents {
+			positions[t] = tr.session.QueuePosition(t)
+		}
+		sort.Slice(torrents, func(i, j int) bool {
+			return positions[torrents[i]] < positions[torrents[j]]
+		})
+		// Move the torrents nearest to where they go first, so they do not
+		// push each other out of place
+		if direction == moveTop || direction == moveDown {
+			for i, j := 0, len(torrents)-1; i < j; i, j = i+1, j-1 {
+				torrents[i], torrents[j] = torrents[j], torrents[i]
+			}
+		}
+		for _, t := range torrents {
+			var position int
+			switch direction {
+			case moveTop:
+				position = 0
+			case moveUp:
+				position = tr.session.QueuePosition(t) - 1
+			case moveDown:
+				position = tr.session.QueuePosition(t) + 1
+			case moveBottom:
+				position = len(tr.session.Queue())
+			}
+			if position < 0 {
+				continue
+			}
+			err = tr.session.MoveQueue(t.ID, position)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,20 @@
+package daemon
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// web holds the pages of the web UI, which talks to the daemon through /rpc
+//
+//go:embed web
+var web embed.FS
+
+func webHandler() http.Handler {
+	root, err := fs.Sub(web, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}
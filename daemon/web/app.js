@@ -0,0 +1,281 @@
+"use strict";
+
+// The page polls the JSON-RPC API of the daemon every second
+const interval = 1000;
+
+let selected = null;
+let lastUploaded = new Map(); // torrent id -> [uploaded bytes, time]
+let uploadRates = new Map();
+
+let nextID = 1;
+
+// The daemon answers 409 with the session id it wants in every request
+const sessionIDHeader = "X-Transmission-Session-Id";
+let sessionID = "";
+
+async function post(body) {
+	return fetch("rpc", {
+		method: "POST",
+		headers: {"Content-Type": "application/json", [sessionIDHeader]: sessionID},
+		body: body,
+	});
+}
+
+async function call(method, params) {
+	const body = JSON.stringify({jsonrpc: "2.0", method: method, params: params, id: nextID++});
+	let resp = await post(body);
+	if (resp.status === 409 && resp.headers.has(sessionIDHeader)) {
+		sessionID = resp.headers.get(sessionIDHeader);
+		resp = await post(body);
+	}
+	if (!resp.ok) {
+		throw new Error(resp.status + " " + resp.statusText);
+	}
+	const res = await resp.json();
+	if (res.error) {
+		throw new Error(res.error.message);
+	}
+	return res.result;
+}
+
+function formatBytes(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return n.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+}
+
+function formatRate(n) {
+	return formatBytes(n) + "/s";
+}
+
+const statusNames = {
+	stopped: "已暂停",
+	downloading: "下载中",
+	seeding: "做种中",
+	error: "出错",
+	queued: "排队下载",
+	"seed-queued": "排队做种",
+};
+
+function cell(row, content) {
+	const td = row.insertCell();
+	if (content instanceof Node) {
+		td.appendChild(content);
+	} else {
+		td.textContent = content;
+	}
+	return td;
+}
+
+function button(label, onclick) {
+	const b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = (e) => {
+		e.stopPropagation();
+		onclick().then(refresh).catch(showError);
+	};
+	return b;
+}
+
+function showError(err) {
+	document.getElementById("error").textContent = err ? err.message : "";
+}
+
+// uploadRate derives the upload rate of a torrent from its upload total,
+// which is all the daemon reports
+function uploadRate(info) {
+	const now = Date.now();
+	const last = lastUploaded.get(info.id);
+	if (last && now > last[1]) {
+		uploadRates.set(info.id, (info.uploaded - last[0]) * 1000 / (now - last[1]));
+	}
+	lastUploaded.set(info.id, [info.uploaded, now]);
+	return uploadRates.get(info.id) || 0;
+}
+
+function renderStats(stats) {
+	document.getElementById("stats").textContent =
+		`${stats.torrents} 个种子，下载 ${formatRate(stats.downloadRate)}，` +
+		`共下载 ${formatBytes(stats.downloaded)}，共上传 ${formatBytes(stats.uploaded)}`;
+
+	const alt = document.getElementById("alt-speed");
+	alt.textContent = stats.altSpeed ? "备用限速：开" : "备用限速：关";
+	alt.className = stats.altSpeed ? "on" : "";
+	if (stats.altSchedule) {
+		alt.title = `${stats.altSchedule.begin}-${stats.altSchedule.end} 自动开启`;
+	}
+	alt.onclick = () => {
+		call("setAltSpeed", {on: !stats.altSpeedOn}).then(refresh).catch(showError);
+	};
+}
+
+function renderTorrents(infos) {
+	const tbody = document.querySelector("#torrents tbody");
+	tbody.textContent = "";
+	infos.sort((a, b) => a.queuePosition - b.queuePosition);
+	for (const info of infos) {
+		const row = tbody.insertRow();
+		if (info.id === selected) {
+			row.className = "selected";
+		}
+		row.onclick = () => {
+			selected = info.id;
+			refresh();
+		};
+		cell(row, info.queuePosition);
+		cell(row, info.name);
+		const status = cell(row, statusNames[info.status] || info.status);
+		if (info.error) {
+			status.className = "status-error";
+			status.title = info.error;
+		}
+		const progress = document.createElement("progress");
+		progress.max = 100;
+		progress.value = info.percent;
+		const td = cell(row, progress);
+		td.append(" " + info.percent.toFixed(1) + "%");
+		cell(row, formatRate(info.downloadRate));
+		cell(row, formatRate(uploadRate(info)));
+		cell(row, info.peers);
+
+		const actions = cell(row, "");
+		if (info.queuePosition > 0) {
+			actions.appendChild(button("↑", () => call("moveQueue", {id: info.id, position: info.queuePosition - 1})));
+		}
+		if (info.queuePosition < infos.length - 1) {
+			actions.appendChild(button("↓", () => call("moveQueue", {id: info.id, position: info.queuePosition + 1})));
+		}
+		if (info.status === "downloading" || info.status === "queued") {
+			actions.appendChild(button("暂停", () => call("pause", {id: info.id})));
+		} else if (info.status === "stopped" || info.status === "error") {
+			actions.appendChild(button("继续", () => call("resume", {id: info.id})));
+		}
+		actions.appendChild(button("删除", () => {
+			if (!confirm(`删除 ${info.name}？`)) {
+				return Promise.resolve();
+			}
+			const deleteData = confirm("同时删除已下载的数据？");
+			if (selected === info.id) {
+				selected = null;
+			}
+			return call("remove", {id: info.id, deleteData: deleteData});
+		}));
+	}
+}
+
+// renderPieces draws one column per piece, or per group of pieces when
+// there are more pieces than pixels, shaded by how many of them are there
+function renderPieces(info) {
+	const canvas = document.getElementById("pieces");
+	canvas.width = canvas.clientWidth;
+	const ctx = canvas.getContext("2d");
+	ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+	const bits = Uint8Array.from(atob(info.pieces || ""), (c) => c.charCodeAt(0));
+	const has = (i) => (bits[i >> 3] >> (7 - (i & 7))) & 1;
+	const total = info.pieceCount;
+	const columns = Math.min(total, canvas.width);
+	if (columns === 0) {
+		return;
+	}
+	const width = canvas.width / columns;
+	for (let c = 0; c < columns; c++) {
+		const first = Math.floor(c * total / columns);
+		const last = Math.floor((c + 1) * total / columns);
+		let done = 0;
+		for (let i = first; i < last; i++) {
+			done += has(i);
+		}
+		const ratio = done / Math.max(1, last - first);
+		ctx.fillStyle = ratio === 0 ? "#eee" : `rgba(40, 110, 220, ${0.3 + 0.7 * ratio})`;
+		ctx.fillRect(c * width, 0, Math.ceil(width), canvas.height);
+	}
+}
+
+function renderPeers(peers) {
+	const tbody = document.querySelector("#peers tbody");
+	tbody.textContent = "";
+	for (const p of peers) {
+		const row = tbody.insertRow();
+		cell(row, p.addr);
+		cell(row, p.direction === "download" ? "下载" : "上传");
+		cell(row, formatBytes(p.downloaded));
+		cell(row, formatBytes(p.uploaded));
+		cell(row, p.direction === "download" ? formatRate(p.rate) : "");
+		cell(row, p.direction === "download" ? p.backlog : "");
+		cell(row, p.choked ? "是" : "");
+	}
+}
+
+function renderFiles(info) {
+	const tbody = document.querySelector("#files tbody");
+	tbody.textContent = "";
+	info.files.forEach((f, i) => {
+		const row = tbody.insertRow();
+		cell(row, f.path);
+		cell(row, formatBytes(f.length));
+		cell(row, f.length ? (100 * f.bytesDone / f.length).toFixed(1) + "%" : "100%");
+		const select = document.createElement("select");
+		for (const p of ["normal", "high", "skip"]) {
+			select.add(new Option(p, p, false, p === f.priority));
+		}
+		select.onchange = () => {
+			call("setFilePriority", {id: info.id, file: i, priority: select.value})
+				.then(refresh).catch(showError);
+		};
+		cell(row, select);
+	});
+}
+
+async function refresh() {
+	try {
+		const [stats, infos] = await Promise.all([call("stats"), call("list")]);
+		renderStats(stats);
+		renderTorrents(infos);
+
+		const info = infos.find((t) => t.id === selected);
+		const details = document.getElementById("details");
+		details.hidden = !info;
+		if (info) {
+			document.getElementById("details-name").textContent = info.name;
+			renderPieces(info);
+			renderPeers(await call("peers", {id: info.id}));
+			// Redrawing the selects would close them while in use
+			if (!document.querySelector("#files select:focus")) {
+				renderFiles(info);
+			}
+		}
+	} catch (err) {
+		showError(err);
+	}
+}
+
+async function add() {
+	const file = document.getElementById("file");
+	const magnet = document.getElementById("magnet");
+	const paused = document.getElementById("paused").checked;
+	let params;
+	if (file.files.length > 0) {
+		params = {metainfo: JSON.parse(await file.files[0].text()), paused: paused};
+	} else if (magnet.value.trim() !== "") {
+		params = {magnet: magnet.value.trim(), paused: paused};
+	} else {
+		throw new Error("请选择种子文件或输入磁力链接");
+	}
+	const info = await call("add", params);
+	file.value = "";
+	magnet.value = "";
+	selected = info.id;
+	showError(null);
+}
+
+document.getElementById("add-button").onclick = () => {
+	add().then(refresh).catch(showError);
+};
+
+refresh();
+setInterval(refresh, interval);
@@ -1,6 +1,6 @@
 module github.com/lvkeliang/P2Pin3
 
-go 1.19
+go 1.21
 
 require (
 	github.com/jackpal/bencode-go v1.0.0
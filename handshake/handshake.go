@@ -1,7 +1,6 @@
 package handshake
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/lvkeliang/P2Pin2/handshake"
 	"io"
@@ -71,34 +70,25 @@ func Read(r io.Reader) (*Handshake, error) {
 	return &h, nil
 }
 
-func PeerHandshake(conn net.Conn, hashmap map[[20]byte]string, peerID [20]byte) (res *handshake.Handshake, filePath string, err error) {
+// PeerHandshake answers the handshake of an incoming peer if known reports
+// that its infohash is being seeded
+func PeerHandshake(conn net.Conn, known func(infoHash [20]byte) bool, peerID [20]byte) (res *handshake.Handshake, err error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	res, err = handshake.Read(conn)
 	if err != nil {
-		return nil, "", fmt.Errorf("%v\n", err)
+		return nil, err
 	}
 
-	var infoHash [20]byte
-
-	flag := false
-	for infoHash, filePath = range hashmap {
-		if bytes.Equal(res.InfoHash[:], infoHash[:]) {
-			flag = true
-			break
-		}
+	if !known(res.InfoHash) {
+		return nil, fmt.Errorf("no file matches with infohash: %x", res.InfoHash)
 	}
 
-	if flag {
-		req := handshake.New(infoHash, peerID)
-		_, err := conn.Write(req.Serialize())
-		if err != nil {
-			return nil, "", err
-		}
-		return res, filePath, nil
-	} else {
-		return nil, "", fmt.Errorf("no file matches with infohash: %v\n", res.InfoHash)
+	req := handshake.New(res.InfoHash, peerID)
+	_, err = conn.Write(req.Serialize())
+	if err != nil {
+		return nil, err
 	}
-
+	return res, nil
 }
@@ -0,0 +1,287 @@
+// Package hooks tells other programs when a download completes: by running
+// a command, posting a JSON webhook or appending the event to a file.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.For(logging.Hooks)
+
+// EventComplete is the type of the event sent when a download completes
+const EventComplete = "complete"
+
+// Defaults of a Runner
+const (
+	DefaultRetryDelay = 2 * time.Second
+	DefaultTimeout    = 30 * time.Second
+)
+
+// Event is what a hook is told about
+type Event struct {
+	Event    string    `json:"event"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"` // where the data was saved
+	InfoHash string    `json:"infoHash"`
+	Length   int64     `json:"length"`
+	Time     time.Time `json:"time"`
+}
+
+// Completed returns the event of a torrent whose download to path completed
+func Completed(t *torrent.TorrentFile, path string) Event {
+	return Event{
+		Event:    EventComplete,
+		Name:     t.Name,
+		Path:     path,
+		InfoHash: hex.EncodeToString(t.InfoHash[:]),
+		Length:   int64(t.Length),
+		Time:     time.Now(),
+	}
+}
+
+// env returns the event as environment variables
+func (ev Event) env() []string {
+	return []string{
+		"P2PIN3_EVENT=" + ev.Event,
+		"P2PIN3_NAME=" + ev.Name,
+		"P2PIN3_PATH=" + ev.Path,
+		"P2PIN3_INFOHASH=" + ev.InfoHash,
+		"P2PIN3_LENGTH=" + strconv.FormatInt(ev.Length, 10),
+	}
+}
+
+// Hook is one action taken on every event. Exactly one of Command, URL and
+// File is set.
+type Hook struct {
+	// Command is run with the event in the P2PIN3_EVENT, P2PIN3_NAME,
+	// P2PIN3_PATH, P2PIN3_INFOHASH and P2PIN3_LENGTH environment variables,
+	// and as JSON on its standard input. It fails if it exits with an error.
+	Command []string
+
+	// URL is posted the event as JSON. It fails unless it answers 2xx.
+	URL string
+
+	// File gets the event appended as a line of JSON
+	File string
+
+	// Retries is how many more times a failed hook is tried
+	Retries int
+}
+
+// Validate checks that the hook does one thing
+func (h Hook) Validate() error {
+	n := 0
+	if len(h.Command) > 0 {
+		n++
+	}
+	if h.URL != "" {
+		n++
+	}
+	if h.File != "" {
+		n++
+	}
+	if n != 1 {
+		return errors.New("a hook needs exactly one of Command, URL and File")
+	}
+	if h.Retries < 0 {
+		return errors.New("hook retries cannot be negative")
+	}
+	return nil
+}
+
+func (h Hook) String() string {
+	switch {
+	case len(h.Command) > 0:
+		return "command " + strings.Join(h.Command, " ")
+	case h.URL != "":
+		return "webhook " + h.URL
+	default:
+		return "file " + h.File
+	}
+}
+
+// Runner runs hooks. A nil Runner runs none.
+type Runner struct {
+	Hooks []Hook
+
+	// RetryDelay is waited before the first retry, and doubled before each
+	// following one. It defaults to DefaultRetryDelay.
+	RetryDelay time.Duration
+	// Timeout bounds each attempt. It defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Client posts the webhooks. It defaults to http.DefaultClient.
+	Client *http.Client
+
+	wg     sync.WaitGroup
+	fileMu sync.Mutex // keeps the lines appended to files whole
+}
+
+// NewRunner creates a runner for hooks, checking them first
+func NewRunner(hooks []Hook) (*Runner, error) {
+	for i, h := range hooks {
+		err := h.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("hook %d: %w", i, err)
+		}
+	}
+	return &Runner{Hooks: hooks}, nil
+}
+
+// Fire runs the hooks for an event in the background, logging the ones that
+// fail. Retries stop when ctx is done; Wait waits for the hooks to return.
+func (r *Runner) Fire(ctx context.Context, ev Event) {
+	if r == nil || len(r.Hooks) == 0 {
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		err := r.Run(ctx, ev)
+		if err != nil {
+			logger.Error("hook failed", "event", ev.Event, logging.KeyInfoHash, ev.InfoHash, logging.Err(err))
+		}
+	}()
+}
+
+// Wait waits for the hooks started by Fire
+func (r *Runner) Wait() {
+	if r != nil {
+		r.wg.Wait()
+	}
+}
+
+// Run runs every hook for an event, retrying the ones that fail, and
+// returns the error of the first one that failed every attempt. The hooks
+// run one after the other, in order.
+func (r *Runner) Run(ctx context.Context, ev Event) error {
+	if r == nil {
+		return nil
+	}
+	var firstErr error
+	for _, h := range r.Hooks {
+		err := r.runHook(ctx, h, ev)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s hook %s for %s: %w", ev.Event, h, ev.Name, err)
+		}
+	}
+	return firstErr
+}
+
+func (r *Runner) runHook(ctx context.Context, h Hook, ev Event) error {
+	err := h.Validate()
+	if err != nil {
+		return err
+	}
+	delay := r.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		err = r.try(ctx, h, ev)
+		if err == nil || attempt == h.Retries {
+			return err
+		}
+		logger.Warn("hook failed, retrying", "hook", h.String(), logging.KeyInfoHash, ev.InfoHash,
+			"delay", delay, logging.Err(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// try runs a hook once
+func (r *Runner) try(ctx context.Context, h Hook, ev Event) error {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(h.Command) > 0:
+		return runCommand(ctx, h.Command, ev, body)
+	case h.URL != "":
+		return r.post(ctx, h.URL, body)
+	default:
+		return r.appendFile(h.File, body)
+	}
+}
+
+func runCommand(ctx context.Context, command []string, ev Event, body []byte) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), ev.env()...)
+	cmd.Stdin = bytes.NewReader(body)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		output = bytes.TrimSpace(output)
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Runner) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+func (r *Runner) appendFile(path string, body []byte) error {
+	r.fileMu.Lock()
+	defer r.fileMu.Unlock()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(body, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,204 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testEvent = Event{
+	Event:    EventComplete,
+	Name:     "video.mp4",
+	Path:     "downloaded/video.mp4",
+	InfoHash: "0123456789abcdef0123456789abcdef01234567",
+	Length:   12345,
+	Time:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+}
+
+func newTestRunner(hooks ...Hook) *Runner {
+	return &Runner{Hooks: hooks, RetryDelay: time.Millisecond, Timeout: 5 * time.Second}
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var ev Event
+		err := json.NewDecoder(r.Body).Decode(&ev)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	err := newTestRunner(Hook{URL: srv.URL}).Run(context.Background(), testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := <-received
+	if !ev.Time.Equal(testEvent.Time) {
+		t.Errorf("time = %v, want %v", ev.Time, testEvent.Time)
+	}
+	ev.Time = testEvent.Time
+	if ev != testEvent {
+		t.Errorf("got %+v, want %+v", ev, testEvent)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	err := newTestRunner(Hook{URL: srv.URL, Retries: 2}).Run(context.Background(), testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("webhook called %d times, want 3", n)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	err := newTestRunner(Hook{URL: srv.URL, Retries: 1}).Run(context.Background(), testEvent)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("err = %v, want the status of the webhook", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("webhook called %d times, want 2", n)
+	}
+}
+
+func TestRetriesStopWithContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	r := newTestRunner(Hook{URL: srv.URL, Retries: 100})
+	r.RetryDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() { done <- r.Run(ctx, testEvent) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("a hook that never succeeded reported no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling did not stop the retries")
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events", "complete.jsonl")
+	r := newTestRunner(Hook{File: path})
+	for i := 0; i < 2; i++ {
+		r.Fire(context.Background(), testEvent)
+	}
+	r.Wait()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev Event
+		err = json.Unmarshal(scanner.Bytes(), &ev)
+		if err != nil {
+			t.Fatalf("line %d: %v", lines, err)
+		}
+		if ev.InfoHash != testEvent.InfoHash {
+			t.Errorf("line %d: infohash = %s", lines, ev.InfoHash)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("%d events written, want 2", lines)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	script := `echo "$P2PIN3_EVENT $P2PIN3_NAME $P2PIN3_PATH $P2PIN3_INFOHASH $P2PIN3_LENGTH" > "$1" && cat >> "$1"`
+	err = newTestRunner(Hook{Command: []string{sh, "-c", script, "sh", out}}).Run(context.Background(), testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, stdin, _ := strings.Cut(string(data), "\n")
+	want := "complete video.mp4 downloaded/video.mp4 " + testEvent.InfoHash + " 12345"
+	if env != want {
+		t.Errorf("environment = %q, want %q", env, want)
+	}
+	var ev Event
+	err = json.Unmarshal([]byte(stdin), &ev)
+	if err != nil || ev.Name != testEvent.Name {
+		t.Errorf("stdin = %q, want the event as JSON", stdin)
+	}
+}
+
+func TestCommandFails(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run")
+	}
+	err = newTestRunner(Hook{Command: []string{sh, "-c", "echo oops >&2; exit 3"}}).Run(context.Background(), testEvent)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("err = %v, want the output of the command", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	bad := []Hook{
+		{},
+		{URL: "http://localhost/", File: "events.jsonl"},
+		{File: "events.jsonl", Retries: -1},
+	}
+	for _, h := range bad {
+		if h.Validate() == nil {
+			t.Errorf("%+v is valid", h)
+		}
+	}
+	_, err := NewRunner([]Hook{{URL: "http://localhost/"}, {}})
+	if err == nil {
+		t.Error("NewRunner accepted a hook doing nothing")
+	}
+}
@@ -0,0 +1,288 @@
+package library
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// version of the file format, written to every file
+const version = 1
+
+// Entry is what the library knows about one torrent
+type Entry struct {
+	Name string
+	// Path is where the data of the torrent is stored
+	Path string
+	// Torrent holds the metadata of the torrent as saved by the torrent
+	// package. It is empty for entries migrated from a hashmap.json.
+	Torrent json.RawMessage `json:",omitempty"`
+	// Bitfield records the pieces known to be complete
+	Bitfield   bitfield.Bitfield `json:",omitempty"`
+	Downloaded int64
+	Uploaded   int64
+	Added      time.Time
+	// Completed is zero while the torrent is still downloading
+	Completed time.Time `json:",omitempty"`
+	// Paused records that the download was stopped by the user
+	Paused bool `json:",omitempty"`
+	// FilePriorities holds the priority of each file of a download, as
+	// numbered by the protocol package
+	FilePriorities []int `json:",omitempty"`
+	// QueuePosition orders the torrents waiting for a slot, from 0
+	QueuePosition int `json:",omitempty"`
+}
+
+// Complete tells if the data of the torrent is all there. Entries migrated
+// from a hashmap.json only ever listed complete data.
+func (e *Entry) Complete() bool {
+	return !e.Completed.IsZero() || len(e.Torrent) == 0
+}
+
+// file is the content of a library file
+type file struct {
+	Version  int
+	Torrents map[string]*Entry // keyed by hex infohash
+}
+
+// DB is a library stored in a single JSON file. Every change is a locked
+// read-modify-write followed by an atomic rename, so several processes can
+// share the same file without losing entries.
+type DB struct {
+	path string
+	mu   sync.Mutex // serializes the goroutines of this process
+}
+
+// Open opens the library at path, creating its directory if needed.
+// A hashmap.json written by older versions, mapping hex infohashes to data
+// paths, is migrated in place; the original is kept with a ".bak" suffix.
+func Open(path string) (*DB, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{path: path}
+	unlock, err := lock(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	entries, legacy, err := db.read()
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		err = copyFile(path, path+".bak")
+		if err != nil {
+			return nil, err
+		}
+		err = db.write(entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Path returns the path of the library file
+func (db *DB) Path() string {
+	return db.path
+}
+
+// All returns every entry of the library
+func (db *DB) All() (map[[20]byte]*Entry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	unlock, err := lock(db.path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	entries, _, err := db.read()
+	return entries, err
+}
+
+// Get returns the entry of a torrent, or nil if there is none
+func (db *DB) Get(infoHash [20]byte) (*Entry, error) {
+	entries, err := db.All()
+	if err != nil {
+		return nil, err
+	}
+	return entries[infoHash], nil
+}
+
+// Update runs fn on the entries of the library and saves what it left in
+// the map. Nothing is saved if fn fails. Other processes using the library
+// wait until the update is written.
+func (db *DB) Update(fn func(entries map[[20]byte]*Entry) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	unlock, err := lock(db.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, _, err := db.read()
+	if err != nil {
+		return err
+	}
+	err = fn(entries)
+	if err != nil {
+		return err
+	}
+	return db.write(entries)
+}
+
+// Put adds or replaces the entry of a torrent, keeping the time it was
+// first added
+func (db *DB) Put(infoHash [20]byte, e *Entry) error {
+	return db.Update(func(entries map[[20]byte]*Entry) error {
+		if old := entries[infoHash]; old != nil && e.Added.IsZero() {
+			e.Added = old.Added
+		}
+		if e.Added.IsZero() {
+			e.Added = time.Now()
+		}
+		entries[infoHash] = e
+		return nil
+	})
+}
+
+// Delete removes the entry of a torrent
+func (db *DB) Delete(infoHash [20]byte) error {
+	return db.Update(func(entries map[[20]byte]*Entry) error {
+		delete(entries, infoHash)
+		return nil
+	})
+}
+
+// read loads the entries, telling if the file used the legacy format.
+// A missing or empty file is an empty library.
+func (db *DB) read() (entries map[[20]byte]*Entry, legacy bool, err error) {
+	entries = make(map[[20]byte]*Entry)
+	data, err := ioutil.ReadFile(db.path)
+	if os.IsNotExist(err) || err == nil && len(data) == 0 {
+		return entries, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading library %s: %w", db.path, err)
+	}
+	if _, ok := raw["Version"]; !ok {
+		entries, err = migrate(raw)
+		if err != nil {
+			return nil, false, fmt.Errorf("migrating %s: %w", db.path, err)
+		}
+		return entries, true, nil
+	}
+
+	var f file
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading library %s: %w", db.path, err)
+	}
+	if f.Version > version {
+		return nil, false, fmt.Errorf("library %s has version %d, newer than %d", db.path, f.Version, version)
+	}
+	for key, e := range f.Torrents {
+		infoHash, err := parseInfoHash(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("reading library %s: %w", db.path, err)
+		}
+		entries[infoHash] = e
+	}
+	return entries, false, nil
+}
+
+// migrate converts the legacy hashmap.json format, a map from hex infohash
+// to data path
+func migrate(raw map[string]json.RawMessage) (map[[20]byte]*Entry, error) {
+	entries := make(map[[20]byte]*Entry)
+	now := time.Now()
+	for key, value := range raw {
+		infoHash, err := parseInfoHash(key)
+		if err != nil {
+			return nil, err
+		}
+		var path string
+		err = json.Unmarshal(value, &path)
+		if err != nil {
+			return nil, err
+		}
+		entries[infoHash] = &Entry{
+			Name:  filepath.Base(path),
+			Path:  path,
+			Added: now,
+		}
+	}
+	return entries, nil
+}
+
+// write saves the entries to a temporary file and renames it over the
+// library, so readers never see a partial file
+func (db *DB) write(entries map[[20]byte]*Entry) error {
+	f := file{Version: version, Torrents: make(map[string]*Entry, len(entries))}
+	for infoHash, e := range entries {
+		f.Torrents[hex.EncodeToString(infoHash[:])] = e
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return infoHash, err
+	}
+	if len(b) != len(infoHash) {
+		return infoHash, fmt.Errorf("infohash %q is not 20 bytes", s)
+	}
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, data, 0644)
+}
@@ -0,0 +1,35 @@
+//go:build !unix
+
+package library
+
+import (
+	"os"
+	"time"
+)
+
+// staleLock is how old a lock file must be to be considered left behind by
+// a process that died while holding it
+const staleLock = 30 * time.Second
+
+// lock takes an exclusive lock shared by every process using the library
+// at path, and returns the function releasing it. Without flock, the lock
+// is a file created exclusively.
+func lock(path string) (func(), error) {
+	name := path + ".lock"
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		info, err := os.Stat(name)
+		if err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(name)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,207 @@
+// Package logging gives each subsystem a structured logger built on
+// log/slog. Records carry the subsystem they come from, and each subsystem
+// has its own level, so that one of them can be debugged without the
+// others flooding the output.
+package logging
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Subsystems logging through this package
+const (
+	Protocol = "protocol" // downloads from peers
+	Seeder   = "seeder"   // uploads to peers
+	Session  = "session"  // the torrents of the daemon
+	Tracker  = "tracker"
+	Watch    = "watch" // shared and inbox folders
+	Hooks    = "hooks"
+	Stream   = "stream"
+	Metrics  = "metrics"
+)
+
+// Keys of the fields shared by every subsystem
+const (
+	KeySubsystem = "subsystem"
+	KeyInfoHash  = "infohash"
+	KeyPeer      = "peer"
+	KeyPiece     = "piece"
+	KeyErr       = "err"
+)
+
+// LevelOff is above every level, turning a subsystem off
+const LevelOff = slog.Level(100)
+
+// InfoHash returns the field naming a torrent by its infohash
+func InfoHash(h [20]byte) slog.Attr {
+	return slog.String(KeyInfoHash, hex.EncodeToString(h[:]))
+}
+
+// Peer returns the field of a peer address
+func Peer(addr string) slog.Attr {
+	return slog.String(KeyPeer, addr)
+}
+
+// Piece returns the field of a piece index
+func Piece(index int) slog.Attr {
+	return slog.Int(KeyPiece, index)
+}
+
+// Err returns the field of an error
+func Err(err error) slog.Attr {
+	return slog.Any(KeyErr, err)
+}
+
+var (
+	mu     sync.RWMutex
+	levels = make(map[string]slog.Level)
+	// fallback is the level of the subsystems without one of their own
+	fallback = slog.LevelInfo
+
+	out    io.Writer = os.Stderr
+	asJSON bool
+	output = newOutput(os.Stderr, false)
+)
+
+func newOutput(w io.Writer, json bool) slog.Handler {
+	// Levels are checked per subsystem before records get here
+	opts := &slog.HandlerOptions{Level: slog.Level(-100)}
+	if json {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// For returns the logger of a subsystem. It follows the later changes of
+// levels and output, so it may be kept in a package variable.
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem}).With(KeySubsystem, subsystem)
+}
+
+// SetLevel sets the level of a subsystem, or of every subsystem without a
+// level of its own when subsystem is empty
+func SetLevel(subsystem string, level slog.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	if subsystem == "" {
+		fallback = level
+		return
+	}
+	levels[subsystem] = level
+}
+
+// Level returns the level of a subsystem
+func Level(subsystem string) slog.Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	level, ok := levels[subsystem]
+	if !ok {
+		return fallback
+	}
+	return level
+}
+
+// Configure sets levels from a spec like "info,protocol=debug,seeder=off":
+// a bare level applies to every subsystem without one of its own. Levels
+// are debug, info, warn, error and off.
+func Configure(spec string) error {
+	type setting struct {
+		subsystem string
+		level     slog.Level
+	}
+	var settings []setting
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, ok := strings.Cut(part, "=")
+		if !ok {
+			subsystem, name = "", part
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		settings = append(settings, setting{strings.TrimSpace(subsystem), level})
+	}
+	// Nothing changes unless the whole spec is valid
+	for _, s := range settings {
+		SetLevel(s.subsystem, s.level)
+	}
+	return nil
+}
+
+// ParseLevel parses debug, info, warn, error or off
+func ParseLevel(name string) (slog.Level, error) {
+	name = strings.TrimSpace(name)
+	if strings.EqualFold(name, "off") {
+		return LevelOff, nil
+	}
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid log level %q, want debug, info, warn, error or off", name)
+	}
+	return level, nil
+}
+
+// SetOutput sends the records to w, io.Discard dropping them
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+	output = newOutput(out, asJSON)
+}
+
+// SetJSON writes the records as lines of JSON rather than as key=value text
+func SetJSON(json bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	asJSON = json
+	output = newOutput(out, asJSON)
+}
+
+// handler checks the level of its subsystem, then hands the record to the
+// output in use at the time, replaying the attributes and groups it was
+// given on it
+type handler struct {
+	subsystem string
+	with      []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= Level(h.subsystem)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	mu.RLock()
+	next := output
+	mu.RUnlock()
+	for _, with := range h.with {
+		next = with(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.and(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.and(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) and(with func(slog.Handler) slog.Handler) *handler {
+	return &handler{
+		subsystem: h.subsystem,
+		with:      append(h.with[:len(h.with):len(h.with)], with),
+	}
+}
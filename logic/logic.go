@@ -162,6 +162,31 @@ func (m *Message) name() string {
 	}
 }
 
+// String describes the message with its decoded fields, like
+// "Request index=3 begin=0 length=16384". A Bitfield shows its bits in hex.
+func (m *Message) String() string {
+	name := m.name()
+	if m == nil {
+		return name
+	}
+	p := m.Payload
+	switch {
+	case m.ID == MsgHave && len(p) == 4:
+		return fmt.Sprintf("%s index=%d", name, binary.BigEndian.Uint32(p))
+	case (m.ID == MsgRequest || m.ID == MsgCancel) && len(p) == 12:
+		return fmt.Sprintf("%s index=%d begin=%d length=%d", name,
+			binary.BigEndian.Uint32(p[0:4]), binary.BigEndian.Uint32(p[4:8]), binary.BigEndian.Uint32(p[8:12]))
+	case m.ID == MsgPiece && len(p) >= 8:
+		return fmt.Sprintf("%s index=%d begin=%d length=%d", name,
+			binary.BigEndian.Uint32(p[0:4]), binary.BigEndian.Uint32(p[4:8]), len(p)-8)
+	case m.ID == MsgBitfield:
+		return fmt.Sprintf("%s %x", name, p)
+	case len(p) > 0:
+		return fmt.Sprintf("%s payload=%x", name, p)
+	}
+	return name
+}
+
 // Peer encodes connection information for a peer
 type Peer struct {
 	IP   net.IP
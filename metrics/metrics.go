@@ -0,0 +1,181 @@
+// Package metrics exposes counters and gauges in the Prometheus text format,
+// gathered when /metrics is scraped.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writer collects the samples of a scrape, grouping them by metric, then
+// writes them out
+type Writer struct {
+	families []*family
+	byName   map[string]*family
+}
+
+type family struct {
+	name, help, typ string
+	samples         []sample
+}
+
+type sample struct {
+	suffix string // like "_bucket" for histograms
+	labels string // already formatted, like {infohash="ab12"}
+	value  float64
+}
+
+// Counter adds a sample of a counter. Labels are given as name and value
+// pairs.
+func (w *Writer) Counter(name, help string, value float64, labels ...string) {
+	w.add(name, help, "counter", "", value, labels)
+}
+
+// Gauge adds a sample of a gauge. Labels are given as name and value pairs.
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	w.add(name, help, "gauge", "", value, labels)
+}
+
+// Histogram adds the buckets, sum and count of a histogram. Labels are
+// given as name and value pairs.
+func (w *Writer) Histogram(name, help string, h *Histogram, labels ...string) {
+	if h == nil {
+		return
+	}
+	bounds, counts, count, sum := h.snapshot()
+	labels = labels[:len(labels):len(labels)] // appending the le label copies them
+	var cumulative uint64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		w.add(name, help, "histogram", "_bucket", float64(cumulative), append(labels, "le", formatFloat(bound)))
+	}
+	w.add(name, help, "histogram", "_bucket", float64(count), append(labels, "le", "+Inf"))
+	w.add(name, help, "histogram", "_sum", sum, labels)
+	w.add(name, help, "histogram", "_count", float64(count), labels)
+}
+
+func (w *Writer) add(name, help, typ, suffix string, value float64, labels []string) {
+	if w.byName == nil {
+		w.byName = make(map[string]*family)
+	}
+	f := w.byName[name]
+	if f == nil {
+		f = &family{name: name, help: help, typ: typ}
+		w.byName[name] = f
+		w.families = append(w.families, f)
+	}
+	f.samples = append(f.samples, sample{suffix: suffix, labels: formatLabels(labels), value: value})
+}
+
+// WriteTo writes every metric in the text format, in the order they were
+// first added
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range w.families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintf(&buf, "%s%s%s %s\n", f.name, s.suffix, s.labels, formatFloat(s.value))
+		}
+	}
+	return buf.WriteTo(out)
+}
+
+// Handler serves the samples written by every collect function
+func Handler(collect ...func(w *Writer)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var w Writer
+		for _, c := range collect {
+			c(&w)
+		}
+		rw.Header().Set("Content-Type", ContentType)
+		w.WriteTo(rw)
+	})
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelReplacer.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// DefaultBuckets suit latencies in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets. It is safe for concurrent
+// use.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, the last one for values above every bound
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with buckets up to each bound, or
+// DefaultBuckets when none is given
+func NewHistogram(bounds ...float64) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultBuckets
+	}
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe counts a value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) snapshot() (bounds []float64, counts []uint64, count uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.bounds, append([]uint64(nil), h.counts...), h.count, h.sum
+}
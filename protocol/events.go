@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType identifies what happened during a download
+type EventType uint8
+
+const (
+	// EventPeerConnected is sent once the handshake with a peer completes
+	EventPeerConnected EventType = iota
+	// EventPeerDisconnected is sent when a worker stops using a peer
+	EventPeerDisconnected
+	// EventPieceVerified is sent when a piece passes its hash check
+	EventPieceVerified
+	// EventHashFailed is sent when a piece fails its hash check
+	EventHashFailed
+	// EventPeerBanned is sent when a peer is banned for sending corrupt data
+	EventPeerBanned
+	// EventProgress is sent periodically with up to date throughput and ETA
+	EventProgress
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventPeerConnected:
+		return "PeerConnected"
+	case EventPeerDisconnected:
+		return "PeerDisconnected"
+	case EventPieceVerified:
+		return "PieceVerified"
+	case EventHashFailed:
+		return "HashFailed"
+	case EventPeerBanned:
+		return "PeerBanned"
+	case EventProgress:
+		return "Progress"
+	default:
+		return fmt.Sprintf("Unknown#%d", uint8(e))
+	}
+}
+
+// Event describes something that happened while downloading a torrent
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Peer     string // address of the peer involved, empty if none
+	Piece    int    // index of the piece involved, -1 if none
+	Err      error  // why a peer was disconnected, if it failed
+	Progress Progress
+}
+
+// Progress summarizes the state of a download
+type Progress struct {
+	PiecesDone  int           // verified pieces among the wanted ones
+	PiecesTotal int           // pieces that are not skipped
+	BytesDone   int64         // bytes of verified pieces
+	BytesTotal  int64         // bytes of the pieces that are not skipped
+	Downloaded  int64         // every payload byte received, including corrupt pieces
+	Peers       int           // connected peers
+	Rate        float64       // bytes per second over the last few seconds
+	ETA         time.Duration // zero when unknown
+	Verified    int           // pieces downloaded and verified, not those already there
+	HashFailed  int           // pieces downloaded that failed their hash check
+}
+
+// Percent returns how much of the wanted data has been verified
+func (p Progress) Percent() float64 {
+	if p.PiecesTotal == 0 {
+		return 100
+	}
+	return float64(p.PiecesDone) / float64(p.PiecesTotal) * 100
+}
+
+// PeerStats describes a connected peer
+type PeerStats struct {
+	Addr           string
+	Downloaded     int64   // payload bytes received from the peer
+	Rate           float64 // bytes per second over the last few seconds
+	Backlog        int     // unfulfilled requests in the pipeline
+	Choked         bool    // whether the peer is choking us
+	Interested     bool    // whether we told the peer we want its pieces
+	PeerInterested bool    // whether the peer told us it wants ours
+}
@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"sync"
+)
+
+// piecePriority orders the pieces handed out by the picker
+type piecePriority uint8
+
+const (
+	// priorityNone marks pieces that are not downloaded at all
+	priorityNone piecePriority = iota
+	priorityNormal
+	priorityHigh
+	// priorityReadahead marks pieces a Reader is about to read
+	priorityReadahead
+)
+
+// picker hands out pieces that still need to be downloaded to the workers.
+// Unlike a plain channel it lets a worker skip over pieces its peer does not
+// have and wait until a piece it can serve is put back. A piece that failed
+// its hash check is kept away from the peers that sent it for as long as
+// another connected peer can serve it instead.
+//
+// Pieces with a higher priority are handed out first and pieces with
+// priorityNone are not handed out at all. Among pieces of the
+// same priority the queue order is kept, unless the picker is sequential or
+// the pieces are being read ahead, in which case the lowest index goes first.
+//
+// Once every connected peer waits, none of them can serve a pending piece
+// and no other peer is still handshaking, the picker is starved: nothing
+// can change while the workers wait, since they do not read the Have
+// messages of their peers, so they are all woken to give up.
+type picker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	pending    []*pieceWork
+	peers      map[string]bitfield.Bitfield
+	priorities []piecePriority
+	sequential bool
+	closed     bool
+	waiting    int  // workers blocked in next
+	connecting int  // workers handshaking with their peer, see connect
+	starved    bool // until something changes
+}
+
+func newPicker(work []*pieceWork, sequential bool) *picker {
+	p := &picker{
+		pending:    work,
+		peers:      make(map[string]bitfield.Bitfield),
+		sequential: sequential,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// setPriorities replaces the priority of every piece
+func (p *picker) setPriorities(priorities []piecePriority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.priorities = priorities
+	p.starved = false
+	p.cond.Broadcast()
+}
+
+func (p *picker) priority(index int) piecePriority {
+	if index >= len(p.priorities) {
+		return priorityNormal
+	}
+	return p.priorities[index]
+}
+
+// before tells if a should be handed out before b
+func (p *picker) before(a, b *pieceWork) bool {
+	pa, pb := p.priority(a.index), p.priority(b.index)
+	if pa != pb {
+		return pa > pb
+	}
+	if p.sequential || pa == priorityReadahead {
+		return a.index < b.index
+	}
+	return false
+}
+
+// connect records that a worker is about to handshake with its peer, which
+// may have pieces the connected peers lack. It is followed by join, or by
+// connectFailed when the handshake fails.
+func (p *picker) connect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connecting++
+}
+
+// connectFailed records that a handshake started by connect failed
+func (p *picker) connectFailed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connecting--
+	// The waiting workers check again whether they are starved
+	p.cond.Broadcast()
+}
+
+// join registers a connected peer and the pieces it has, ending connect
+func (p *picker) join(peer string, bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connecting--
+	p.peers[peer] = bf
+	p.starved = false
+	p.cond.Broadcast()
+}
+
+// leave unregisters a peer, letting pieces it was avoided for go to others
+func (p *picker) leave(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, peer)
+	p.cond.Broadcast()
+}
+
+// have records that a peer announced a new piece
+func (p *picker) have(peer string, index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if bf, ok := p.peers[peer]; ok {
+		bf.SetPiece(index)
+		p.starved = false
+		p.cond.Broadcast()
+	}
+}
+
+// next removes and returns the most urgent pending piece that the peer
+// should download. When wait is true it blocks until such a piece is
+// available, otherwise it returns false right away. It also returns false
+// once the picker is closed or starved.
+func (p *picker) next(peer string, wait bool) (*pieceWork, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && !p.starved {
+		best := -1
+		for i, pw := range p.pending {
+			if p.assignable(pw, peer) && (best < 0 || p.before(pw, p.pending[best])) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			pw := p.pending[best]
+			p.pending = append(p.pending[:best], p.pending[best+1:]...)
+			return pw, true
+		}
+		if !wait {
+			return nil, false
+		}
+		p.waiting++
+		if p.waiting >= len(p.peers) && p.connecting == 0 && !p.servable() {
+			p.starved = true
+			p.cond.Broadcast()
+		} else {
+			p.cond.Wait()
+		}
+		p.waiting--
+	}
+	return nil, false
+}
+
+// servable tells if a connected peer can serve a pending piece
+func (p *picker) servable() bool {
+	for _, pw := range p.pending {
+		for peer := range p.peers {
+			if p.assignable(pw, peer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *picker) assignable(pw *pieceWork, peer string) bool {
+	if p.priority(pw.index) == priorityNone || !p.peers[peer].HasPiece(pw.index) {
+		return false
+	}
+	if !pw.failedBy[peer] {
+		return true
+	}
+	// Re-download from a different peer if one can serve the piece
+	for other, bf := range p.peers {
+		if !pw.failedBy[other] && bf.HasPiece(pw.index) {
+			return false
+		}
+	}
+	return true
+}
+
+// requeue puts pieces back so that another worker can pick them up
+func (p *picker) requeue(work ...*pieceWork) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, work...)
+	p.starved = false
+	p.cond.Broadcast()
+}
+
+// close wakes every waiting worker and makes next return false from now on
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"math"
+	"time"
+)
+
+// pipelineGain is how many bandwidth-delay products worth of requests are kept
+// in flight. A gain above 1 lets the pipeline grow while a link is still
+// limited by the number of outstanding requests rather than by its bandwidth.
+const pipelineGain = 2
+
+// rateWindow is the interval over which received bytes are turned into a
+// throughput sample
+const rateWindow = 500 * time.Millisecond
+
+// rttWindow is how long a minimum round trip time sample is trusted before it
+// is replaced by a fresh one
+const rttWindow = 10 * time.Second
+
+// backlogController sizes the request pipeline of a single peer from its
+// measured throughput and round trip time, so that enough requests are in
+// flight to cover the bandwidth-delay product of the link without flooding a
+// slow peer.
+type backlogController struct {
+	rate        float64 // bytes per second, exponentially weighted
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	windowStart time.Time
+	windowBytes int
+}
+
+// observe records a block of n bytes that arrived rtt after it was requested
+func (c *backlogController) observe(n int, rtt time.Duration) {
+	now := time.Now()
+
+	if rtt > 0 && (c.minRTT == 0 || rtt < c.minRTT || now.Sub(c.minRTTStamp) > rttWindow) {
+		c.minRTT = rtt
+		c.minRTTStamp = now
+	}
+
+	if c.windowStart.IsZero() {
+		c.windowStart = now
+	}
+	c.windowBytes += n
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	sample := float64(c.windowBytes) / elapsed.Seconds()
+	if c.rate == 0 {
+		c.rate = sample
+	} else {
+		c.rate = 0.7*c.rate + 0.3*sample
+	}
+	c.windowStart = now
+	c.windowBytes = 0
+}
+
+// size returns the number of unfulfilled requests to keep in the pipeline
+func (c *backlogController) size() int {
+	if c.rate == 0 || c.minRTT == 0 {
+		return initialBacklog
+	}
+	bdp := c.rate * c.minRTT.Seconds() / MaxBlockSize
+	n := int(math.Ceil(bdp * pipelineGain))
+	if n < MinBacklog {
+		return MinBacklog
+	}
+	if n > MaxBacklog {
+		return MaxBacklog
+	}
+	return n
+}
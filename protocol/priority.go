@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/storage"
+)
+
+// File is one of the files of a multi-file torrent
+type File = storage.File
+
+// FilePriority tells how urgently a file should be downloaded
+type FilePriority uint8
+
+const (
+	// PriorityNormal is the default priority of every file
+	PriorityNormal FilePriority = iota
+	// PrioritySkip leaves a file out of the download
+	PrioritySkip
+	// PriorityHigh downloads a file before the files of normal priority
+	PriorityHigh
+)
+
+func (p FilePriority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PrioritySkip:
+		return "skip"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("Unknown#%d", uint8(p))
+	}
+}
+
+// ParseFilePriority parses the names returned by FilePriority.String
+func ParseFilePriority(s string) (FilePriority, error) {
+	switch s {
+	case "normal":
+		return PriorityNormal, nil
+	case "skip":
+		return PrioritySkip, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return 0, fmt.Errorf("unknown file priority %q", s)
+}
+
+func (p FilePriority) piecePriority() piecePriority {
+	switch p {
+	case PrioritySkip:
+		return priorityNone
+	case PriorityHigh:
+		return priorityHigh
+	default:
+		return priorityNormal
+	}
+}
+
+// FileList returns the files of the torrent. A single-file torrent has one
+// file named after the torrent.
+func (t *Torrent) FileList() []File {
+	if len(t.Files) == 0 {
+		return []File{{Path: t.Name, Length: t.Length}}
+	}
+	return t.Files
+}
+
+// fileBounds returns where a file starts and ends in the torrent's data
+func (t *Torrent) fileBounds(index int) (begin, end int64) {
+	for i, f := range t.FileList() {
+		if i == index {
+			return begin, begin + int64(f.Length)
+		}
+		begin += int64(f.Length)
+	}
+	return begin, begin
+}
+
+// FilePriority returns the priority of a file
+func (t *Torrent) FilePriority(index int) FilePriority {
+	t.init()
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	return t.filePriority(index)
+}
+
+func (t *Torrent) filePriority(index int) FilePriority {
+	if index < len(t.FilePriorities) {
+		return t.FilePriorities[index]
+	}
+	return PriorityNormal
+}
+
+// SetFilePriority changes the priority of a file. It can be called while the
+// download runs: pieces of a file that is no longer skipped are queued, and
+// the download completes without the pieces of a file that becomes skipped.
+func (t *Torrent) SetFilePriority(index int, p FilePriority) error {
+	files := t.FileList()
+	if index < 0 || index >= len(files) {
+		return fmt.Errorf("file index %d out of range [0, %d)", index, len(files))
+	}
+	t.init()
+	t.state.mu.Lock()
+	for len(t.FilePriorities) < len(files) {
+		t.FilePriorities = append(t.FilePriorities, PriorityNormal)
+	}
+	t.FilePriorities[index] = p
+	t.state.mu.Unlock()
+	t.reprioritize()
+	return nil
+}
+
+// reprioritize recomputes the priority of every piece from the priorities of
+// the files it belongs to and the readahead window of every reader. A piece
+// shared by a skipped and a wanted file is wanted.
+func (t *Torrent) reprioritize() {
+	readahead := int64(t.Readahead)
+	if readahead <= 0 {
+		readahead = DefaultReadahead
+	}
+	pieceLength := int64(t.PieceLength)
+
+	s := t.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	priorities := make([]piecePriority, len(t.PieceHashes))
+	var offset int64
+	for i, f := range t.FileList() {
+		length := int64(f.Length)
+		if length > 0 {
+			p := t.filePriority(i).piecePriority()
+			last := int((offset + length - 1) / pieceLength)
+			for j := int(offset / pieceLength); j <= last && j < len(priorities); j++ {
+				if p > priorities[j] {
+					priorities[j] = p
+				}
+			}
+		}
+		offset += length
+	}
+
+	for r := range s.readers {
+		pos := r.offset + r.pos
+		end := r.offset + r.length
+		if pos >= end {
+			continue
+		}
+		if pos+readahead < end {
+			end = pos + readahead
+		}
+		last := int((end - 1) / pieceLength)
+		for i := int(pos / pieceLength); i <= last && i < len(priorities); i++ {
+			priorities[i] = priorityReadahead
+		}
+	}
+
+	s.setWanted(t, priorities)
+	if s.picker != nil {
+		s.picker.setPriorities(priorities)
+	}
+}
@@ -2,20 +2,51 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/lvkeliang/P2Pin3/application"
+	"github.com/lvkeliang/P2Pin3/connlimit"
+	"github.com/lvkeliang/P2Pin3/logging"
 	"github.com/lvkeliang/P2Pin3/logic"
-	"log"
-	"runtime"
+	"github.com/lvkeliang/P2Pin3/ratelimit"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/wiretrace"
+	"sync"
 	"time"
 )
 
+var logger = logging.For(logging.Protocol)
+
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
-const MaxBacklog = 5
+// MinBacklog is the smallest number of unfulfilled requests kept in a peer's pipeline
+const MinBacklog = 2
+
+// MaxBacklog is the largest number of unfulfilled requests a client can have in its pipeline
+const MaxBacklog = 256
+
+// initialBacklog is used for a peer until its throughput and round trip time are known
+const initialBacklog = 5
+
+// maxPeerRefreshes is how many times in a row PeerSource is asked for peers,
+// failing or without any of them completing a handshake, before the
+// download gives up
+const maxPeerRefreshes = 3
+
+// peerRefreshInterval is the pause between two unsuccessful calls to PeerSource
+const peerRefreshInterval = 5 * time.Second
+
+// ErrNoPeers is returned by Download when every peer is gone and there is no
+// way to find new ones. It wraps the last error of PeerSource, if any.
+var ErrNoPeers = errors.New("no live peers and no source of new ones")
+
+// errNoPieces ends the workers once none of their peers has a piece left to
+// download
+var errNoPieces = errors.New("no connected peer has a piece left to download")
 
 // Torrent holds data required to download a torrent from a list of peers
 type Torrent struct {
@@ -26,12 +57,61 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	// Files lists the files of a multi-file torrent; it is empty for a
+	// single-file torrent
+	Files []File
+
+	// Storage receives the downloaded pieces. Download keeps them in memory
+	// when it is nil.
+	Storage storage.Storage
+
+	// FilePriorities holds the priority of each file, PriorityNormal for
+	// files past its end. Use SetFilePriority once the download runs.
+	FilePriorities []FilePriority
+
+	// Bans refuses peers that sent too much corrupt data. It may be shared
+	// between torrents; a fresh list is used when it is nil.
+	Bans *BanList
+
+	// PeerSource, when set, is asked for more peers once every known peer
+	// has disconnected, typically by announcing to the tracker again.
+	PeerSource func(ctx context.Context) ([]logic.Peer, error)
+
+	// Sequential downloads pieces in order rather than in the order they
+	// were queued, so that a file can be played while it downloads.
+	Sequential bool
+
+	// Readahead is how many bytes after the position of each Reader are
+	// downloaded before anything else. DefaultReadahead is used when zero.
+	Readahead int
+
+	// DownloadLimit caps the download rate. It may be shared between
+	// torrents to cap their total rate; nil means unlimited.
+	DownloadLimit *ratelimit.Limiter
+
+	// Conns caps the connections to peers. It may be shared between
+	// torrents and servers to cap their total; nil means unlimited.
+	Conns *connlimit.Limiter
+
+	// Trace records the messages exchanged with every peer; nil records
+	// none
+	Trace *wiretrace.Tracer
+
+	// OnEvent, when set, receives progress and peer events. It is called
+	// from the download goroutines, one event at a time, and should return
+	// quickly.
+	OnEvent func(Event)
+
+	stateOnce sync.Once
+	state     *torrentState
 }
 
 type pieceWork struct {
-	index  int
-	hash   [20]byte
-	length int
+	index    int
+	hash     [20]byte
+	length   int
+	failedBy map[string]bool // peers that sent a corrupt copy of this piece
 }
 
 type pieceResult struct {
@@ -39,17 +119,116 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type PieceProgress struct {
-	index      int
-	client     *application.Client
+// pieceProgress tracks a piece that a worker is currently downloading
+type pieceProgress struct {
+	work       *pieceWork
 	buf        []byte
 	downloaded int
 	requested  int
-	backlog    int
 }
 
-func (state *PieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
+type blockKey struct {
+	index int
+	begin int
+}
+
+// peerWorker downloads pieces from a single peer. It keeps the pipeline of
+// requests to the peer full, spreading requests over as many pieces as
+// needed instead of waiting for one piece to finish before asking for the next.
+type peerWorker struct {
+	ctx      context.Context
+	t        *Torrent
+	stats    *peerState
+	peer     string
+	client   *application.Client
+	picker   *picker
+	rep      *reputation
+	results  chan *pieceResult
+	active   []*pieceProgress
+	sent     map[blockKey]time.Time
+	backlog  int
+	pipeline backlogController
+}
+
+func (w *peerWorker) run() error {
+	for {
+		// The peer may have been banned for blocks it sent to another piece
+		if w.rep.bans.IsBanned(w.peer) {
+			return fmt.Errorf("peer %s is banned", w.peer)
+		}
+
+		err := w.fillPipeline()
+		if err != nil {
+			return err
+		}
+
+		if len(w.active) == 0 {
+			// Nothing in flight, wait for a piece this peer can serve
+			pw, ok := w.picker.next(w.peer, true)
+			if !ok {
+				// The picker is closed once the download is cancelled,
+				// otherwise it is starved
+				if w.ctx.Err() != nil {
+					return nil
+				}
+				return errNoPieces
+			}
+			w.active = append(w.active, &pieceProgress{work: pw, buf: make([]byte, pw.length)})
+			continue
+		}
+
+		// Setting a deadline helps get unresponsive peers unstuck.
+		w.client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+		err = w.readMessage()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fillPipeline sends requests until the backlog reaches the size the peer's
+// link can sustain, taking new pieces from the picker when the active ones
+// are fully requested.
+func (w *peerWorker) fillPipeline() error {
+	for !w.client.Choked && w.backlog < w.pipeline.size() {
+		state := w.nextUnrequested()
+		if state == nil {
+			pw, ok := w.picker.next(w.peer, false)
+			if !ok {
+				return nil
+			}
+			state = &pieceProgress{work: pw, buf: make([]byte, pw.length)}
+			w.active = append(w.active, state)
+		}
+
+		blockSize := MaxBlockSize
+		// Last block might be shorter than the typical block
+		if state.work.length-state.requested < blockSize {
+			blockSize = state.work.length - state.requested
+		}
+		err := w.client.SendRequest(state.work.index, state.requested, blockSize)
+		if err != nil {
+			return err
+		}
+		w.sent[blockKey{state.work.index, state.requested}] = time.Now()
+		w.backlog++
+		w.stats.backlog.Store(int32(w.backlog))
+		state.requested += blockSize
+	}
+	return nil
+}
+
+func (w *peerWorker) nextUnrequested() *pieceProgress {
+	for _, state := range w.active {
+		if state.requested < state.work.length {
+			return state
+		}
+	}
+	return nil
+}
+
+func (w *peerWorker) readMessage() error {
+	msg, err := w.client.Read() // this call blocks
 	if err != nil {
 		return err
 	}
@@ -60,110 +239,246 @@ func (state *PieceProgress) readMessage() error {
 
 	switch msg.ID {
 	case logic.MsgUnchoke:
-		state.client.Choked = false
+		w.client.Choked = false
+		w.stats.choked.Store(false)
 	case logic.MsgChoke:
-		state.client.Choked = true
+		w.client.Choked = true
+		w.stats.choked.Store(true)
+		w.dropRequests()
+	case logic.MsgInterested:
+		w.stats.peerInterested.Store(true)
+	case logic.MsgNotInterested:
+		w.stats.peerInterested.Store(false)
 	case logic.MsgHave:
 		index, err := logic.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
+		w.picker.have(w.peer, index)
 	case logic.MsgPiece:
-		n, err := logic.ParsePiece(state.index, state.buf, msg)
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+		}
+		key := blockKey{
+			index: int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+			begin: int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+		}
+		sentAt, ok := w.sent[key]
+		if !ok {
+			return nil // not requested, or already received
+		}
+		state := w.activePiece(key.index)
+		n, err := logic.ParsePiece(key.index, state.buf, msg)
 		if err != nil {
 			return err
 		}
+		delete(w.sent, key)
+		w.pipeline.observe(n, time.Since(sentAt))
+		w.t.state.downloaded.add(n)
+		w.stats.downloaded.add(n)
 		state.downloaded += n
-		state.backlog--
+		w.backlog--
+		w.stats.backlog.Store(int32(w.backlog))
+		err = w.t.DownloadLimit.WaitN(w.ctx, n)
+		if err != nil {
+			return err
+		}
+		if state.downloaded >= state.work.length {
+			return w.finishPiece(state)
+		}
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *application.Client, pw *pieceWork) ([]byte, error) {
-	state := PieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-	state.client.Choked = false
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+// dropRequests forgets the requests in flight, which a peer discards when
+// it chokes us, so that they are sent again once it unchokes. Each active
+// piece is requested again from its first block not received.
+func (w *peerWorker) dropRequests() {
+	for _, state := range w.active {
+		for key := range w.sent {
+			if key.index == state.work.index && key.begin < state.requested {
+				state.requested = key.begin
 			}
 		}
+		state.downloaded = state.requested
+	}
+	w.sent = make(map[blockKey]time.Time)
+	w.backlog = 0
+	w.stats.backlog.Store(0)
+}
+
+func (w *peerWorker) activePiece(index int) *pieceProgress {
+	for _, state := range w.active {
+		if state.work.index == index {
+			return state
+		}
+	}
+	return nil
+}
 
-		err := state.readMessage()
+// finishPiece verifies a fully received piece. It returns an error when the
+// peer ends up banned for the data it sent.
+func (w *peerWorker) finishPiece(state *pieceProgress) error {
+	for i, s := range w.active {
+		if s == state {
+			w.active = append(w.active[:i], w.active[i+1:]...)
+			break
+		}
+	}
 
-		if err != nil {
-			return nil, err
+	pw := state.work
+	err := checkIntegrity(pw, state.buf)
+	if err != nil {
+		logger.Warn("piece failed its hash check", logging.InfoHash(w.t.InfoHash), logging.Peer(w.peer),
+			logging.Piece(pw.index))
+		w.t.state.failedPiece()
+		w.t.emit(Event{Type: EventHashFailed, Peer: w.peer, Piece: pw.index, Err: err})
+		banned := w.rep.failed(pw.index, w.peer, state.buf)
+		if pw.failedBy == nil {
+			pw.failedBy = make(map[string]bool)
+		}
+		pw.failedBy[w.peer] = true
+		w.picker.requeue(pw) // Put piece back on the queue
+		if banned {
+			w.t.emit(Event{Type: EventPeerBanned, Peer: w.peer, Piece: pw.index})
+			return fmt.Errorf("peer %s banned after sending corrupt pieces", w.peer)
 		}
+		return nil
+	}
+
+	for _, peer := range w.rep.verified(pw.index, state.buf) {
+		logger.Warn("banned peer for sending corrupt data", logging.InfoHash(w.t.InfoHash), logging.Peer(peer),
+			logging.Piece(pw.index))
+		w.t.emit(Event{Type: EventPeerBanned, Peer: peer, Piece: pw.index})
+	}
+	w.client.SendHave(pw.index)
+	select {
+	case w.results <- &pieceResult{pw.index, state.buf}:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
 	}
+	return nil
+}
 
-	return state.buf, nil
+// release puts every piece the worker has not finished back on the queue
+func (w *peerWorker) release() {
+	for _, state := range w.active {
+		w.picker.requeue(state.work)
+	}
+	w.active = nil
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("Index %d failed integrity check, want hash: %d, got: %d\n", pw.index, pw.hash[:], hash[:])
+		return fmt.Errorf("piece %d failed its hash check, want %x, got %x", pw.index, pw.hash[:], hash[:])
 	}
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer logic.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := application.New(peer, t.PeerID, t.InfoHash)
+// startDownloadWorker downloads from a single peer until the torrent is done,
+// the peer fails, no connected peer has a piece left or ctx is cancelled. It
+// reports whether the handshake with the peer succeeded and the peer had
+// pieces to download.
+func (t *Torrent) startDownloadWorker(ctx context.Context, peer logic.Peer, picker *picker, rep *reputation, results chan *pieceResult) bool {
+	if rep.bans.IsBanned(peer.String()) {
+		logger.Debug("refusing banned peer", logging.InfoHash(t.InfoHash), logging.Peer(peer.String()))
+		return false
+	}
+	slot, err := t.Conns.Dial(ctx)
 	if err != nil {
-		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+		return false
+	}
+	defer slot.Release()
+	// Counted only once it holds a slot: a worker waiting for a connected
+	// peer to give up its slot would keep the picker from ever starving
+	picker.connect()
+	c, err := application.DialTraced(ctx, peer, t.PeerID, t.InfoHash, t.Trace)
+	if err != nil {
+		picker.connectFailed()
+		logger.Debug("handshake failed", logging.InfoHash(t.InfoHash), logging.Peer(peer.String()), logging.Err(err))
+		return false
 	}
 	defer c.Conn.Close()
+	slot.Established()
+	addr := peer.String()
+	logger.Debug("connected to peer", logging.InfoHash(t.InfoHash), logging.Peer(addr))
+	stats := t.state.addPeer(addr)
+	t.emit(Event{Type: EventPeerConnected, Peer: addr, Piece: -1})
+
+	// Closing the connection unblocks any pending read once ctx is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.Close()
+		case <-stop:
+		}
+	}()
+
 	c.SendUnchoke()
 	c.SendInterested()
-	for pw := range workQueue {
-		// fmt.Println("pw: ", *pw)
-		if !c.Bitfield.HasPiece(pw.index) {
+	c.Choked = false
+	stats.interested.Store(true)
 
-			log.Printf("Completed handshake with %s\n", peer.IP)
-			workQueue <- pw // Put piece back on the queue
-			continue
+	w := &peerWorker{
+		ctx:     ctx,
+		t:       t,
+		stats:   stats,
+		peer:    addr,
+		client:  c,
+		picker:  picker,
+		rep:     rep,
+		results: results,
+		sent:    make(map[blockKey]time.Time),
+	}
+	picker.join(w.peer, c.Bitfield)
+	defer picker.leave(w.peer)
+	err = w.run()
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Info("disconnected from peer", logging.InfoHash(t.InfoHash), logging.Peer(addr), logging.Err(err))
 		}
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
+		w.release()
+	}
+	t.state.removePeer(addr)
+	t.emit(Event{Type: EventPeerDisconnected, Peer: addr, Piece: -1, Err: err})
+	return !errors.Is(err, errNoPieces)
+}
 
-		if err != nil {
-			log.Printf("*pw: %v\n", *pw)
-			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
-			return
+// refreshPeers asks PeerSource for new peers after every known peer has gone.
+// attempts counts the previous calls that produced no usable peer, and is
+// increased by every call made, failing ones included, until it reaches
+// maxPeerRefreshes.
+func (t *Torrent) refreshPeers(ctx context.Context, attempts *int) ([]logic.Peer, error) {
+	if t.PeerSource == nil {
+		return nil, ErrNoPeers
+	}
+	var lastErr error
+	for *attempts < maxPeerRefreshes {
+		if *attempts > 0 {
+			select {
+			case <-time.After(peerRefreshInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			fmt.Println(err)
-			workQueue <- pw // Put piece back on the queue
-			continue
+		*attempts++
+		peers, err := t.PeerSource(ctx)
+		if err == nil {
+			return peers, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		logger.Warn("cannot find new peers", logging.InfoHash(t.InfoHash), "attempt", *attempts, logging.Err(err))
+		lastErr = err
 	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoPeers, lastErr)
+	}
+	return nil, ErrNoPeers
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
@@ -180,43 +495,120 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-// Download downloads the torrent. This stores the entire file in memory.
-func (t *Torrent) Download() ([]byte, error) {
-	log.Println("Starting download for", t.Name)
+// Download downloads the torrent into its Storage, keeping it in memory when
+// Storage is nil. Pieces already marked complete in the storage are not
+// downloaded again, nor are pieces that only belong to skipped files.
+// It stops every worker and closes their connections when ctx is cancelled,
+// and fails with ErrNoPeers once no peer is left to download from, peers
+// lacking every piece still needed counting as gone.
+// Readers created with NewReader see each piece as soon as it is verified.
+func (t *Torrent) Download(ctx context.Context) (err error) {
+	logger.Info("starting download", logging.InfoHash(t.InfoHash), "name", t.Name)
+	t.init()
+	if t.Storage == nil {
+		t.Storage = storage.NewMemory(t.Layout())
+	}
 	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	var work []*pieceWork
 	results := make(chan *pieceResult)
 	for index, hash := range t.PieceHashes {
+		if t.Storage.Completed(index) {
+			continue
+		}
 		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+		work = append(work, &pieceWork{index: index, hash: hash, length: length})
 	}
+	picker := newPicker(work, t.Sequential)
+	t.state.start(len(t.PieceHashes), t.Storage, picker)
+	defer func() {
+		t.state.finish(err)
+	}()
+	t.reprioritize()
+	if t.state.complete() {
+		return nil
+	}
+	if t.Bans == nil {
+		t.Bans = NewBanList()
+	}
+	rep := newReputation(t.Bans)
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		picker.close()
+		wg.Wait()
+	}()
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	// Start workers. Each one reports on exits whether it got connected.
+	exits := make(chan bool)
+	live := 0
+	startWorkers := func(peers []logic.Peer) {
+		for _, peer := range peers {
+			live++
+			wg.Add(1)
+			go func(peer logic.Peer) {
+				defer wg.Done()
+				connected := t.startDownloadWorker(workerCtx, peer, picker, rep, results)
+				select {
+				case exits <- connected:
+				case <-workerCtx.Done():
+				}
+			}(peer)
+		}
 	}
+	startWorkers(t.Peers)
+	refreshes := 0
 
-	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
-	startTime := time.Now()
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
+	// Store results until every wanted piece is there
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for !t.state.complete() {
+		for live == 0 {
+			peers, err := t.refreshPeers(ctx, &refreshes)
+			if err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("download of %s cancelled: %w", t.Name, ctx.Err())
+				}
+				return err
+			}
+			startWorkers(peers)
+		}
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		elapsedTime := time.Since(startTime).Seconds()
-		downloadSpeed := float64(begin) / elapsedTime
-		//fmt.Println("pieceNum: ", len(t.PieceHashes))
-		numWorkers := runtime.NumGoroutine() - 3 // subtract 1 for main thread
-		fmt.Printf("\r(%0.2f%%) 下载了第 #%d 块，来自 %d 个节点，速度: %0.2f MB/s", percent, res.index, numWorkers, downloadSpeed/1048576)
-		//log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		var res *pieceResult
+		select {
+		case res = <-results:
+		case connected := <-exits:
+			live--
+			if connected {
+				refreshes = 0
+			}
+			continue
+		case now := <-ticker.C:
+			t.state.tick(now)
+			t.emit(Event{Type: EventProgress, Piece: -1})
+			continue
+		case <-t.state.wake:
+			continue // file priorities changed
+		case <-ctx.Done():
+			return fmt.Errorf("download of %s cancelled: %w", t.Name, ctx.Err())
+		}
+
+		err := t.state.storePiece(res.index, res.buf)
+		if err != nil {
+			return fmt.Errorf("storing piece #%d of %s: %w", res.index, t.Name, err)
+		}
+		t.emit(Event{Type: EventPieceVerified, Piece: res.index})
 	}
 
-	fmt.Printf("\n")
-	close(workQueue)
+	return nil
+}
 
-	return buf, nil
+// Layout describes how the torrent's pieces map onto its files
+func (t *Torrent) Layout() storage.Layout {
+	return storage.Layout{
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Files:       t.Files,
+	}
 }
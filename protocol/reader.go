@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultReadahead is the readahead window used when Torrent.Readahead is zero
+const DefaultReadahead = 4 << 20
+
+var errReaderClosed = errors.New("reader closed")
+
+// errNotDownloaded is returned when the download ended without a piece,
+// because the file it belongs to was skipped
+var errNotDownloaded = errors.New("data was not downloaded")
+
+// Reader reads the data of a torrent, or of one of its files, while it
+// downloads. Reads block until the requested bytes are verified, and the
+// pieces just after the reader's position are downloaded before any other.
+type Reader struct {
+	t      *Torrent
+	offset int64 // where the data read starts in the torrent
+	length int64
+	pos    int64
+	piece  int // piece under pos when priorities were last updated
+	closed bool
+}
+
+// NewReader creates a reader over the whole torrent, positioned at its
+// start. The reader keeps influencing the download order until it is closed.
+func (t *Torrent) NewReader() *Reader {
+	return t.newReader(0, int64(t.Length))
+}
+
+// NewFileReader creates a reader over a single file of the torrent
+func (t *Torrent) NewFileReader(index int) (*Reader, error) {
+	files := t.FileList()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range [0, %d)", index, len(files))
+	}
+	begin, end := t.fileBounds(index)
+	return t.newReader(begin, end-begin), nil
+}
+
+func (t *Torrent) newReader(offset, length int64) *Reader {
+	t.init()
+	r := &Reader{
+		t:      t,
+		offset: offset,
+		length: length,
+		piece:  int(offset / int64(t.PieceLength)),
+	}
+	t.state.mu.Lock()
+	t.state.readers[r] = struct{}{}
+	t.state.mu.Unlock()
+	t.reprioritize()
+	return r
+}
+
+// Read reads up to len(p) bytes, waiting until they have been downloaded and
+// verified. It fails if the download ends without them.
+func (r *Reader) Read(p []byte) (int, error) {
+	t := r.t
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	at := r.offset + r.pos
+	index := int(at / int64(t.PieceLength))
+	if index != r.piece {
+		r.piece = index
+		t.reprioritize()
+	}
+
+	s := t.state
+	s.mu.Lock()
+	for !r.closed && !s.have.HasPiece(index) && !s.ended {
+		s.cond.Wait()
+	}
+	if r.closed {
+		s.mu.Unlock()
+		return 0, errReaderClosed
+	}
+	if !s.have.HasPiece(index) {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = errNotDownloaded
+		}
+		return 0, err
+	}
+	st := s.storage
+	s.mu.Unlock()
+
+	// Verified pieces never change, so they can be read without the lock
+	begin, end := t.calculateBoundsForPiece(index)
+	if int64(end) > r.offset+r.length {
+		end = int(r.offset + r.length)
+	}
+	if len(p) > end-int(at) {
+		p = p[:end-int(at)]
+	}
+	n, err := st.ReadAt(p, index, int(at)-begin)
+	s.mu.Lock()
+	r.pos += int64(n)
+	s.mu.Unlock()
+	return n, err
+}
+
+// Seek sets the position of the next Read and moves the readahead window
+// there. Seeking past the end is allowed; reads there return io.EOF.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	s := r.t.state
+	s.mu.Lock()
+	r.pos = pos
+	s.mu.Unlock()
+	r.piece = int((r.offset + pos) / int64(r.t.PieceLength))
+	r.t.reprioritize()
+	return pos, nil
+}
+
+// Close stops the reader from influencing the download and unblocks a Read
+// waiting for data
+func (r *Reader) Close() error {
+	s := r.t.state
+	s.mu.Lock()
+	r.closed = true
+	delete(s.readers, r)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	r.t.reprioritize()
+	return nil
+}
@@ -0,0 +1,166 @@
+package protocol
+
+import (
+	"crypto/sha1"
+	"sort"
+	"sync"
+)
+
+// BanThreshold is the number of corrupt pieces attributed to a peer before it is banned
+const BanThreshold = 3
+
+// BanList records peers that sent corrupt data and refuses them once they
+// cross BanThreshold. A BanList can be shared by several torrents so that a
+// peer banned in one download is refused by the others.
+type BanList struct {
+	mu      sync.Mutex
+	strikes map[string]int
+	banned  map[string]bool
+}
+
+// NewBanList creates an empty ban list
+func NewBanList() *BanList {
+	return &BanList{
+		strikes: make(map[string]int),
+		banned:  make(map[string]bool),
+	}
+}
+
+// Strike attributes a corrupt piece to a peer and reports whether the peer
+// is banned as a result
+func (b *BanList) Strike(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.strikes[addr]++
+	if b.strikes[addr] >= BanThreshold {
+		b.banned[addr] = true
+	}
+	return b.banned[addr]
+}
+
+// Ban bans a peer regardless of its strikes
+func (b *BanList) Ban(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.banned[addr] = true
+}
+
+// IsBanned tells if a peer has been banned
+func (b *BanList) IsBanned(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banned[addr]
+}
+
+// Strikes returns the number of corrupt pieces attributed to a peer
+func (b *BanList) Strikes(addr string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.strikes[addr]
+}
+
+// Banned lists the addresses of every banned peer
+func (b *BanList) Banned() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := make([]string, 0, len(b.banned))
+	for addr := range b.banned {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// blockRecord remembers which peer sent a block of a piece that failed its
+// hash check, and what the block hashed to
+type blockRecord struct {
+	peer string
+	sum  [20]byte
+}
+
+// reputation attributes hash failures to the peers that caused them. When a
+// piece fails, the hash of every block is stored along with its sender. Once
+// the piece is downloaded again (preferably from another peer) and passes,
+// the stored blocks are compared with the good data and only the peers whose
+// blocks differ are struck. A peer that keeps failing the same piece on its
+// own is struck without waiting for a good copy.
+type reputation struct {
+	mu       sync.Mutex
+	bans     *BanList
+	suspects map[int]map[int][]blockRecord // piece index -> block offset -> senders
+}
+
+func newReputation(bans *BanList) *reputation {
+	return &reputation{
+		bans:     bans,
+		suspects: make(map[int]map[int][]blockRecord),
+	}
+}
+
+// failed records the blocks of a corrupt piece that was sent by peer and
+// reports whether the peer is now banned
+func (r *reputation) failed(index int, peer string, buf []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	blocks, ok := r.suspects[index]
+	if !ok {
+		blocks = make(map[int][]blockRecord)
+		r.suspects[index] = blocks
+	}
+
+	repeated := false
+	for begin := 0; begin < len(buf); begin += MaxBlockSize {
+		for _, rec := range blocks[begin] {
+			if rec.peer == peer {
+				repeated = true
+			}
+		}
+		blocks[begin] = append(blocks[begin], blockRecord{peer, blockSum(buf, begin)})
+	}
+
+	if repeated {
+		return r.bans.Strike(peer)
+	}
+	return false
+}
+
+// verified compares a piece that passed its hash check against the blocks
+// recorded when it failed, striking every peer that sent a differing block.
+// It returns the peers that are now banned.
+func (r *reputation) verified(index int, buf []byte) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	blocks, ok := r.suspects[index]
+	if !ok {
+		return nil
+	}
+	delete(r.suspects, index)
+
+	guilty := make(map[string]bool)
+	for begin, records := range blocks {
+		sum := blockSum(buf, begin)
+		for _, rec := range records {
+			if rec.sum != sum {
+				guilty[rec.peer] = true
+			}
+		}
+	}
+
+	var banned []string
+	for peer := range guilty {
+		if r.bans.Strike(peer) {
+			banned = append(banned, peer)
+		}
+	}
+	return banned
+}
+
+func blockSum(buf []byte, begin int) [20]byte {
+	end := begin + MaxBlockSize
+	if end > len(buf) {
+		end = len(buf)
+	}
+	return sha1.Sum(buf[begin:end])
+}
@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often throughput is sampled and EventProgress sent
+const progressInterval = time.Second
+
+// meter counts bytes and turns them into a smoothed rate each time it ticks
+type meter struct {
+	total atomic.Int64
+
+	mu       sync.Mutex
+	last     int64
+	lastTick time.Time
+	rate     float64
+}
+
+func (m *meter) add(n int) {
+	m.total.Add(int64(n))
+}
+
+func (m *meter) tick(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := m.total.Load()
+	if !m.lastTick.IsZero() {
+		elapsed := now.Sub(m.lastTick).Seconds()
+		if elapsed > 0 {
+			sample := float64(total-m.last) / elapsed
+			m.rate = 0.5*m.rate + 0.5*sample
+		}
+	}
+	m.last = total
+	m.lastTick = now
+}
+
+func (m *meter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rate
+}
+
+// peerState holds the counters of a connected peer
+type peerState struct {
+	downloaded meter
+	backlog    atomic.Int32
+	choked     atomic.Bool
+
+	interested     atomic.Bool
+	peerInterested atomic.Bool
+}
+
+// torrentState holds the counters and data of a running download. It is
+// shared by the workers and read by Stats, PeerStats and readers.
+type torrentState struct {
+	downloaded meter
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when a piece is stored or the download ends
+	peers   map[string]*peerState
+	storage storage.Storage
+	have    bitfield.Bitfield
+	picker  *picker
+	ended   bool  // whether the last download has returned
+	err     error // why the download ended, if it failed
+	readers map[*Reader]struct{}
+
+	// wanted holds the pieces that are not skipped, the totals count the
+	// wanted pieces and the verified ones among them
+	wanted       bitfield.Bitfield
+	wantedPieces int
+	wantedBytes  int64
+	donePieces   int
+	doneBytes    int64
+
+	// verified and hashFailed count the pieces downloaded since the
+	// torrent was created
+	verified   int
+	hashFailed int
+
+	// wake tells Download that the set of wanted pieces changed
+	wake chan struct{}
+
+	emitMu sync.Mutex
+}
+
+func (t *Torrent) init() {
+	t.stateOnce.Do(func() {
+		s := &torrentState{
+			peers:   make(map[string]*peerState),
+			readers: make(map[*Reader]struct{}),
+			wake:    make(chan struct{}, 1),
+		}
+		s.cond = sync.NewCond(&s.mu)
+		t.state = s
+	})
+}
+
+// start prepares a new download into st, taking the pieces already complete
+// there into account
+func (s *torrentState) start(numPieces int, st storage.Storage, picker *picker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storage = st
+	s.have = make(bitfield.Bitfield, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		if st.Completed(i) {
+			s.have.SetPiece(i)
+		}
+	}
+	s.picker = picker
+	s.ended = false
+	s.err = nil
+	s.cond.Broadcast()
+}
+
+// storePiece writes a verified piece to storage and wakes the readers
+// waiting for it
+func (s *torrentState) storePiece(index int, piece []byte) error {
+	_, err := s.storage.WriteAt(piece, index, 0)
+	if err != nil {
+		return err
+	}
+	err = s.storage.MarkComplete(index)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.have.SetPiece(index)
+	s.verified++
+	if s.wanted.HasPiece(index) {
+		s.donePieces++
+		s.doneBytes += int64(len(piece))
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// finish records how the download ended and wakes every waiting reader
+func (s *torrentState) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.picker = nil
+	s.ended = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// setWanted updates the wanted pieces and totals from piece priorities.
+// The caller holds s.mu.
+func (s *torrentState) setWanted(t *Torrent, priorities []piecePriority) {
+	s.wanted = make(bitfield.Bitfield, (len(priorities)+7)/8)
+	s.wantedPieces, s.wantedBytes = 0, 0
+	s.donePieces, s.doneBytes = 0, 0
+	for i, p := range priorities {
+		if p == priorityNone {
+			continue
+		}
+		size := int64(t.calculatePieceSize(i))
+		s.wanted.SetPiece(i)
+		s.wantedPieces++
+		s.wantedBytes += size
+		if s.have.HasPiece(i) {
+			s.donePieces++
+			s.doneBytes += size
+		}
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// complete tells if every wanted piece has been verified
+func (s *torrentState) complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.donePieces == s.wantedPieces
+}
+
+// failedPiece counts a piece that failed its hash check
+func (s *torrentState) failedPiece() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashFailed++
+}
+
+func (s *torrentState) addPeer(addr string) *peerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := &peerState{}
+	s.peers[addr] = ps
+	return ps
+}
+
+func (s *torrentState) removePeer(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, addr)
+}
+
+func (s *torrentState) tick(now time.Time) {
+	s.downloaded.tick(now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ps := range s.peers {
+		ps.downloaded.tick(now)
+	}
+}
+
+// Stats returns a snapshot of the download's progress
+func (t *Torrent) Stats() Progress {
+	t.init()
+	s := t.state
+	s.mu.Lock()
+	p := Progress{
+		PiecesDone:  s.donePieces,
+		PiecesTotal: s.wantedPieces,
+		BytesDone:   s.doneBytes,
+		BytesTotal:  s.wantedBytes,
+		Downloaded:  s.downloaded.total.Load(),
+		Peers:       len(s.peers),
+		Rate:        s.downloaded.Rate(),
+		Verified:    s.verified,
+		HashFailed:  s.hashFailed,
+	}
+	s.mu.Unlock()
+
+	if p.Rate > 0 {
+		remaining := float64(p.BytesTotal - p.BytesDone)
+		p.ETA = time.Duration(remaining / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+// Have returns a copy of the bitfield of the pieces verified so far, nil
+// before the download starts
+func (t *Torrent) Have() bitfield.Bitfield {
+	t.init()
+	s := t.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.have == nil {
+		return nil
+	}
+	return append(bitfield.Bitfield(nil), s.have...)
+}
+
+// PeerStats returns a snapshot of every connected peer, sorted by address
+func (t *Torrent) PeerStats() []PeerStats {
+	t.init()
+	s := t.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]PeerStats, 0, len(s.peers))
+	for addr, ps := range s.peers {
+		stats = append(stats, PeerStats{
+			Addr:           addr,
+			Downloaded:     ps.downloaded.total.Load(),
+			Rate:           ps.downloaded.Rate(),
+			Backlog:        int(ps.backlog.Load()),
+			Choked:         ps.choked.Load(),
+			Interested:     ps.interested.Load(),
+			PeerInterested: ps.peerInterested.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// emit delivers an event to OnEvent, one event at a time
+func (t *Torrent) emit(e Event) {
+	if t.OnEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Progress = t.Stats()
+	t.state.emitMu.Lock()
+	defer t.state.emitMu.Unlock()
+	t.OnEvent(e)
+}
@@ -0,0 +1,153 @@
+package resume
+
+import (
+	"crypto/sha1"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Cache remembers which pieces of the torrents being seeded are complete, so
+// their data is hashed once rather than on every connection. An entry is
+// rebuilt when the size or modification time of one of its files changes.
+type Cache struct {
+	// Workers is the number of pieces hashed in parallel
+	Workers int
+
+	mu      sync.Mutex
+	entries map[[20]byte]*entry
+}
+
+type entry struct {
+	ready  chan struct{} // closed once have is computed
+	path   string
+	stamps []stamp
+	have   bitfield.Bitfield
+}
+
+// stamp identifies a version of a file; size is -1 when it does not exist
+type stamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewCache creates an empty cache hashing with one worker per CPU
+func NewCache() *Cache {
+	return &Cache{
+		Workers: runtime.NumCPU(),
+		entries: make(map[[20]byte]*entry),
+	}
+}
+
+// Bitfield returns the pieces of t stored at path whose hash matches. Callers
+// asking for a torrent that is being hashed wait for the result instead of
+// hashing it again. The bitfield is shared and must not be modified.
+func (c *Cache) Bitfield(t *torrent.TorrentFile, path string) bitfield.Bitfield {
+	layout := t.Layout()
+	stamps := statFiles(path, layout)
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[t.InfoHash]
+		if !ok {
+			e = &entry{ready: make(chan struct{}), path: path, stamps: stamps}
+			c.entries[t.InfoHash] = e
+			c.mu.Unlock()
+			e.have = c.hash(t, path, layout)
+			close(e.ready)
+			return e.have
+		}
+		c.mu.Unlock()
+
+		<-e.ready
+		if e.path == path && sameStamps(e.stamps, stamps) {
+			return e.have
+		}
+		// The data changed since it was hashed
+		c.mu.Lock()
+		if c.entries[t.InfoHash] == e {
+			delete(c.entries, t.InfoHash)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Forget drops the entry of a torrent, if any
+func (c *Cache) Forget(infoHash [20]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, infoHash)
+}
+
+// hash checks every piece against its hash using c.Workers goroutines.
+// Pieces that cannot be read, because a file is missing or too short, are
+// left out.
+func (c *Cache) hash(t *torrent.TorrentFile, path string, layout storage.Layout) bitfield.Bitfield {
+	st := storage.OpenFile(path, layout)
+	defer st.Close()
+
+	have := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	var mu sync.Mutex
+	pieces := make(chan int)
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, layout.PieceLength)
+			for i := range pieces {
+				piece := buf[:layout.PieceSize(i)]
+				_, err := st.ReadAt(piece, i, 0)
+				if err != nil || sha1.Sum(piece) != t.PieceHashes[i] {
+					continue
+				}
+				mu.Lock()
+				have.SetPiece(i)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range t.PieceHashes {
+		pieces <- i
+	}
+	close(pieces)
+	wg.Wait()
+	return have
+}
+
+func statFiles(path string, layout storage.Layout) []stamp {
+	st := storage.OpenFile(path, layout)
+	n := len(layout.Files)
+	if n == 0 {
+		n = 1
+	}
+	stamps := make([]stamp, n)
+	for i := range stamps {
+		info, err := os.Stat(st.FilePath(i))
+		if err != nil {
+			stamps[i] = stamp{size: -1}
+			continue
+		}
+		stamps[i] = stamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	return stamps
+}
+
+func sameStamps(a, b []stamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package seeder
+
+import (
+	"context"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"time"
+)
+
+// Announce tells the tracker of every seeded torrent that the peer listening
+// on port has it, then again every interval, or as soon as a torrent is
+// added, until ctx is done
+func (r *Registry) Announce(ctx context.Context, peerID [20]byte, port uint16, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, seed := range r.Seeds() {
+			if seed.Torrent.Announce == "" {
+				continue
+			}
+			start := time.Now()
+			peers, err := seed.Torrent.AnnounceSeed(ctx, peerID, port)
+			if ctx.Err() != nil {
+				return
+			}
+			seed.Tracker.Record(len(peers), time.Since(start), err)
+			if err != nil {
+				logger.Warn("announce failed", logging.InfoHash(seed.Torrent.InfoHash), logging.Err(err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.added:
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package seeder
+
+import (
+	"encoding/hex"
+	"github.com/lvkeliang/P2Pin3/metrics"
+)
+
+// WriteMetrics writes the uploads, peers and announces of every seed,
+// labelled with its infohash
+func (r *Registry) WriteMetrics(w *metrics.Writer) {
+	seeds := r.Seeds()
+	w.Gauge("p2pin3_torrents", "Torrents by status.", float64(len(seeds)), "status", "seeding")
+	for _, seed := range seeds {
+		infoHash := hex.EncodeToString(seed.Torrent.InfoHash[:])
+		w.Gauge("p2pin3_torrent_info", "Name and status of a torrent, always 1.", 1,
+			"infohash", infoHash, "name", seed.Torrent.Name, "status", "seeding")
+		w.Counter("p2pin3_uploaded_bytes_total", "Payload bytes uploaded.", float64(seed.Uploaded.Load()), "infohash", infoHash)
+
+		peers := seed.Peers()
+		pending := 0
+		for _, p := range peers {
+			pending += p.Pending
+		}
+		w.Gauge("p2pin3_peers", "Connected peers.", float64(len(peers)), "infohash", infoHash, "direction", "upload")
+		w.Gauge("p2pin3_request_queue_depth", "Block requests not answered yet, by us when uploading.",
+			float64(pending), "infohash", infoHash, "direction", "upload")
+		seed.Tracker.WriteMetrics(w, infoHash)
+	}
+}
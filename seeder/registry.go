@@ -0,0 +1,305 @@
+package seeder
+
+import (
+	"context"
+	"github.com/lvkeliang/P2Pin3/library"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/resume"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Seed is a torrent being seeded and the data it is served from
+type Seed struct {
+	Torrent *torrent.TorrentFile
+	Path    string
+	Storage storage.Storage // read-only, shared by every connection
+
+	// Uploaded counts the payload bytes sent to peers
+	Uploaded atomic.Int64
+	rate     rate // of Uploaded, see Registry.MeasureRates
+
+	// Tracker records the announces made by Registry.Announce
+	Tracker *torrent.Tracker
+
+	fromLibrary bool
+
+	mu    sync.Mutex
+	peers map[*peer]struct{}
+}
+
+// PeerStats is a snapshot of a peer downloading a seed
+type PeerStats struct {
+	Addr       string
+	Uploaded   int64 // payload bytes sent to the peer
+	Pending    int   // requests received and not answered yet
+	Interested bool  // whether the peer told us it wants our pieces
+	Connected  time.Time
+}
+
+type peer struct {
+	addr       string
+	uploaded   atomic.Int64
+	pending    atomic.Int32
+	interested atomic.Bool
+	connected  time.Time
+}
+
+// Peers returns a snapshot of every peer connected to the seed, sorted by
+// address
+func (s *Seed) Peers() []PeerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]PeerStats, 0, len(s.peers))
+	for p := range s.peers {
+		stats = append(stats, PeerStats{
+			Addr:       p.addr,
+			Uploaded:   p.uploaded.Load(),
+			Pending:    int(p.pending.Load()),
+			Interested: p.interested.Load(),
+			Connected:  p.connected,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+func (s *Seed) addPeer(addr string) *peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers == nil {
+		s.peers = make(map[*peer]struct{})
+	}
+	p := &peer{addr: addr, connected: time.Now()}
+	s.peers[p] = struct{}{}
+	return p
+}
+
+func (s *Seed) removePeer(p *peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, p)
+}
+
+// rate smooths a byte counter into a rate each time it ticks
+type rate struct {
+	mu       sync.Mutex
+	last     int64
+	lastTick time.Time
+	perSec   float64
+}
+
+func (r *rate) tick(total int64, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastTick.IsZero() {
+		elapsed := now.Sub(r.lastTick).Seconds()
+		if elapsed > 0 {
+			sample := float64(total-r.last) / elapsed
+			r.perSec = 0.5*r.perSec + 0.5*sample
+		}
+	}
+	r.last = total
+	r.lastTick = now
+}
+
+// UploadRate returns the upload rate in bytes per second, zero unless the
+// registry runs MeasureRates
+func (s *Seed) UploadRate() float64 {
+	s.rate.mu.Lock()
+	defer s.rate.mu.Unlock()
+	return s.rate.perSec
+}
+
+// Registry holds the torrents being seeded, keyed by infohash
+type Registry struct {
+	// Cache remembers which pieces of each torrent are complete
+	Cache *resume.Cache
+
+	// Storage is how the data of the seeds is read, plain files when empty
+	Storage storage.Backend
+
+	mu    sync.RWMutex
+	seeds map[[20]byte]*Seed
+
+	added chan struct{} // signalled when a torrent is added
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		Cache: resume.NewCache(),
+		seeds: make(map[[20]byte]*Seed),
+		added: make(chan struct{}, 1),
+	}
+}
+
+// Add starts seeding the data at path, replacing any torrent with the same
+// infohash. Its pieces are hashed in the background.
+func (r *Registry) Add(t *torrent.TorrentFile, path string) {
+	r.add(t, path, false)
+}
+
+func (r *Registry) add(t *torrent.TorrentFile, path string, fromLibrary bool) {
+	st, err := r.Storage.Open(path, t.Layout())
+	if err != nil {
+		// Plain files can always be opened, failing on each read instead
+		logger.Warn("cannot open storage, reading plain files", logging.InfoHash(t.InfoHash), "path", path,
+			"storage", r.Storage, logging.Err(err))
+		st = storage.OpenFile(path, t.Layout())
+	}
+	seed := &Seed{
+		Torrent:     t,
+		Path:        path,
+		Storage:     st,
+		Tracker:     torrent.NewTracker(t),
+		fromLibrary: fromLibrary,
+	}
+	r.mu.Lock()
+	old := r.seeds[t.InfoHash]
+	r.seeds[t.InfoHash] = seed
+	r.mu.Unlock()
+	if old != nil {
+		old.Storage.Close()
+		r.Cache.Forget(t.InfoHash)
+	}
+	go r.Cache.Bitfield(t, path)
+	select {
+	case r.added <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops seeding a torrent. Connections already serving it are not
+// closed.
+func (r *Registry) Remove(infoHash [20]byte) {
+	r.mu.Lock()
+	seed := r.seeds[infoHash]
+	delete(r.seeds, infoHash)
+	r.mu.Unlock()
+	if seed != nil {
+		seed.Storage.Close()
+		r.Cache.Forget(infoHash)
+	}
+}
+
+// Lookup returns the seed of a torrent
+func (r *Registry) Lookup(infoHash [20]byte) (*Seed, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seed, ok := r.seeds[infoHash]
+	return seed, ok
+}
+
+// Has tells if a torrent is being seeded
+func (r *Registry) Has(infoHash [20]byte) bool {
+	_, ok := r.Lookup(infoHash)
+	return ok
+}
+
+// Seeds returns every torrent being seeded
+func (r *Registry) Seeds() []*Seed {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seeds := make([]*Seed, 0, len(r.seeds))
+	for _, seed := range r.seeds {
+		seeds = append(seeds, seed)
+	}
+	return seeds
+}
+
+// Load seeds every complete torrent recorded in the library at dbPath. Entries
+// migrated from an old hashmap.json carry no metadata, which is then read
+// from torrentDir. Torrents previously loaded from the library and no
+// longer in it are removed; torrents added with Add are left alone. Only new
+// or moved entries have their metadata parsed.
+func (r *Registry) Load(dbPath, torrentDir string) error {
+	db, err := library.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	entries, err := db.All()
+	if err != nil {
+		return err
+	}
+
+	for infoHash, e := range entries {
+		if !e.Complete() {
+			delete(entries, infoHash)
+			continue
+		}
+		seed, ok := r.Lookup(infoHash)
+		if ok && seed.Path == e.Path {
+			continue
+		}
+		var t torrent.TorrentFile
+		if len(e.Torrent) > 0 {
+			t, err = torrent.FromEntry(e)
+		} else {
+			t, err = torrent.LoadTorrentFile(filepath.Join(torrentDir, filepath.Base(e.Path)+".json"))
+		}
+		if err != nil {
+			logger.Warn("cannot seed", logging.InfoHash(infoHash), "path", e.Path, logging.Err(err))
+			continue
+		}
+		r.add(&t, e.Path, true)
+	}
+
+	for _, seed := range r.Seeds() {
+		_, ok := entries[seed.Torrent.InfoHash]
+		if seed.fromLibrary && !ok {
+			r.Remove(seed.Torrent.InfoHash)
+		}
+	}
+	return nil
+}
+
+// MeasureRates samples the upload rate of every seed each interval until
+// ctx is done
+func (r *Registry) MeasureRates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, seed := range r.Seeds() {
+				seed.rate.tick(seed.Uploaded.Load(), now)
+			}
+		}
+	}
+}
+
+// Watch calls Load whenever the library file changes, checking every
+// interval until ctx is done
+func (r *Registry) Watch(ctx context.Context, dbPath, torrentDir string, interval time.Duration) {
+	var last os.FileInfo
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(dbPath)
+		if err != nil {
+			continue
+		}
+		if last != nil && info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+			continue
+		}
+		last = info
+		err = r.Load(dbPath, torrentDir)
+		if err != nil {
+			logger.Warn("cannot reload the library", "path", dbPath, logging.Err(err))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package seeder
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/application"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"github.com/lvkeliang/P2Pin3/connlimit"
+	"github.com/lvkeliang/P2Pin3/handshake"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/logic"
+	"github.com/lvkeliang/P2Pin3/ratelimit"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/wiretrace"
+	"io"
+	"net"
+)
+
+var logger = logging.For(logging.Seeder)
+
+// MaxBlockLength is the longest block a peer may request; peers ask for
+// 16 KiB, a few clients for up to 128 KiB
+const MaxBlockLength = 128 * 1024
+
+// Server seeds the torrents of a registry to every peer connecting to it
+type Server struct {
+	Registry *Registry
+	PeerID   [20]byte
+
+	// UploadLimit caps the total upload rate; nil means unlimited
+	UploadLimit *ratelimit.Limiter
+
+	// Conns caps the connections; peers connecting past it are refused.
+	// nil means unlimited.
+	Conns *connlimit.Limiter
+
+	// Trace records the messages of every connection; nil records none
+	Trace *wiretrace.Tracer
+}
+
+// Serve accepts connections on l and serves each of them in its own
+// goroutine, routing them by the infohash of their handshake
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		slot, ok := s.Conns.Accept()
+		if !ok {
+			conn.Close()
+			continue
+		}
+		conn = s.Trace.Conn(conn)
+		go func() {
+			defer slot.Release()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// 处理握手
+	res, err := handshake.PeerHandshake(conn, s.Registry.Has, s.PeerID)
+	if err != nil {
+		return
+	}
+	seed, ok := s.Registry.Lookup(res.InfoHash)
+	if !ok {
+		return
+	}
+
+	addr := conn.RemoteAddr().String()
+	log := logger.With(logging.InfoHash(res.InfoHash), logging.Peer(addr))
+	log.Debug("peer connected")
+	p := seed.addPeer(addr)
+	defer seed.removePeer(p)
+
+	bitfield := s.Registry.Cache.Bitfield(seed.Torrent, seed.Path)
+	_, err = conn.Write((&logic.Message{ID: logic.MsgBitfield, Payload: bitfield}).Serialize())
+	if err != nil {
+		return
+	}
+
+	requests := make(chan logic.Message)
+	defer close(requests)
+	done := make(chan struct{})
+
+	layout := seed.Torrent.Layout()
+	go func() {
+		defer close(done)
+		for req := range requests {
+			index, begin, length, err := application.ParseRequest(&req)
+			if err == nil {
+				err = checkRequest(layout, bitfield, index, begin, length)
+			}
+			if err != nil {
+				log.Warn("invalid request", logging.Err(err))
+				conn.Close()
+				return
+			}
+
+			// 构造回复
+			buf := make([]byte, length+8)
+			binary.BigEndian.PutUint32(buf[0:4], uint32(index))
+			binary.BigEndian.PutUint32(buf[4:8], uint32(begin))
+			n, err := seed.Storage.ReadAt(buf[8:], index, begin)
+			if err != nil {
+				// 关闭连接以结束下面的读循环
+				log.Error("cannot read block", logging.Piece(index), "begin", begin, logging.Err(err))
+				conn.Close()
+				return
+			}
+			err = s.UploadLimit.WaitN(context.Background(), n)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			msg := logic.Message{ID: logic.MsgPiece, Payload: buf[:n+8]}
+			_, err = conn.Write(msg.Serialize())
+			if err != nil {
+				conn.Close()
+				return
+			}
+			seed.Uploaded.Add(int64(n))
+			p.uploaded.Add(int64(n))
+			p.pending.Add(-1)
+		}
+	}()
+
+	// 处理请求
+	for {
+		msg, err := logic.Read(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Debug("peer disconnected", logging.Err(err))
+			}
+			break
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case logic.MsgInterested:
+			p.interested.Store(true)
+		case logic.MsgNotInterested:
+			p.interested.Store(false)
+		case logic.MsgRequest:
+			p.pending.Add(1)
+			select {
+			case requests <- *msg:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// checkRequest checks that a request is for a block of a piece the seeder
+// has, before a buffer of the length the peer chose is allocated for it
+func checkRequest(layout storage.Layout, have bitfield.Bitfield, index, begin, length int) error {
+	if index < 0 || index >= layout.NumPieces() {
+		return fmt.Errorf("piece %d out of range", index)
+	}
+	if !have.HasPiece(index) {
+		return fmt.Errorf("piece %d is not available", index)
+	}
+	if length <= 0 || length > MaxBlockLength {
+		return fmt.Errorf("block length %d out of range", length)
+	}
+	if begin < 0 || begin+length > layout.PieceSize(index) {
+		return fmt.Errorf("block %d+%d past the end of piece %d", begin, length, index)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package session
+
+import "github.com/lvkeliang/P2Pin3/metrics"
+
+// WriteMetrics writes the state of the session and of every torrent, in
+// queue order, labelling the torrents with their infohash
+func (s *Session) WriteMetrics(w *metrics.Writer) {
+	st := s.Stats()
+	statuses := []Status{StatusStopped, StatusQueued, StatusDownloading, StatusSeedQueued, StatusSeeding, StatusError}
+	torrents := s.Queue()
+	counts := make(map[string]int)
+	infos := make([]Info, len(torrents))
+	for i, t := range torrents {
+		infos[i] = s.Info(t)
+		counts[infos[i].Status]++
+	}
+	for _, status := range statuses {
+		w.Gauge("p2pin3_torrents", "Torrents by status.", float64(counts[status.String()]), "status", status.String())
+	}
+	// The queues are the torrents waiting for a slot to download or seed
+	w.Gauge("p2pin3_queue_length", "Torrents waiting for a slot.", float64(counts[StatusQueued.String()]), "queue", "download")
+	w.Gauge("p2pin3_queue_length", "Torrents waiting for a slot.", float64(counts[StatusSeedQueued.String()]), "queue", "seed")
+	w.Gauge("p2pin3_active_limit", "Torrents allowed to run at once, 0 for no limit.", float64(st.MaxActiveDownloads), "queue", "download")
+	w.Gauge("p2pin3_active_limit", "Torrents allowed to run at once, 0 for no limit.", float64(st.MaxActiveSeeds), "queue", "seed")
+	w.Gauge("p2pin3_connections", "Open peer connections.", float64(st.Conns-st.HalfOpen), "state", "established")
+	w.Gauge("p2pin3_connections", "Open peer connections.", float64(st.HalfOpen), "state", "half_open")
+	w.Gauge("p2pin3_connection_limit", "Connections allowed at once, 0 for no limit.", float64(st.MaxConns), "state", "all")
+	w.Gauge("p2pin3_connection_limit", "Connections allowed at once, 0 for no limit.", float64(st.MaxHalfOpen), "state", "half_open")
+	w.Gauge("p2pin3_rate_limit_bytes", "Rate limit applying now in bytes per second, 0 for none.", float64(s.DownloadLimit.Rate()), "direction", "download")
+	w.Gauge("p2pin3_rate_limit_bytes", "Rate limit applying now in bytes per second, 0 for none.", float64(s.UploadLimit.Rate()), "direction", "upload")
+	altSpeed := 0.0
+	if st.AltSpeed {
+		altSpeed = 1
+	}
+	w.Gauge("p2pin3_alt_speed", "Whether the alternate rate limits apply.", altSpeed)
+
+	for i, t := range torrents {
+		s.writeTorrentMetrics(w, t, infos[i])
+	}
+}
+
+func (s *Session) writeTorrentMetrics(w *metrics.Writer, t *Torrent, info Info) {
+	infoHash := info.InfoHash
+	w.Gauge("p2pin3_torrent_info", "Name and status of a torrent, always 1.", 1,
+		"infohash", infoHash, "name", info.Name, "status", info.Status)
+	w.Counter("p2pin3_downloaded_bytes_total", "Payload bytes downloaded, corrupt pieces included.",
+		float64(info.Downloaded), "infohash", infoHash)
+	w.Counter("p2pin3_uploaded_bytes_total", "Payload bytes uploaded.", float64(info.Uploaded), "infohash", infoHash)
+	w.Counter("p2pin3_pieces_verified_total", "Pieces downloaded that passed their hash check.",
+		float64(info.Verified), "infohash", infoHash)
+	w.Counter("p2pin3_pieces_failed_total", "Pieces downloaded that failed their hash check.",
+		float64(info.HashFailed), "infohash", infoHash)
+	w.Gauge("p2pin3_pieces_done", "Wanted pieces that are there.", float64(info.PiecesDone), "infohash", infoHash)
+	w.Gauge("p2pin3_pieces_wanted", "Pieces that are not skipped.", float64(info.PiecesTotal), "infohash", infoHash)
+	w.Gauge("p2pin3_download_rate_bytes", "Download rate in bytes per second.", info.DownloadRate, "infohash", infoHash)
+
+	var downloading, uploading, choked, unchoked, downloadQueue, uploadQueue int
+	for _, p := range s.Peers(t) {
+		if p.Direction == "upload" {
+			uploading++
+			uploadQueue += p.Backlog
+			continue
+		}
+		downloading++
+		downloadQueue += p.Backlog
+		if p.Choked {
+			choked++
+		} else {
+			unchoked++
+		}
+	}
+	w.Gauge("p2pin3_peers", "Connected peers.", float64(downloading), "infohash", infoHash, "direction", "download")
+	w.Gauge("p2pin3_peers", "Connected peers.", float64(uploading), "infohash", infoHash, "direction", "upload")
+	w.Gauge("p2pin3_peers_choke_state", "Peers we download from, by whether they choke us.",
+		float64(choked), "infohash", infoHash, "state", "choked")
+	w.Gauge("p2pin3_peers_choke_state", "Peers we download from, by whether they choke us.",
+		float64(unchoked), "infohash", infoHash, "state", "unchoked")
+	w.Gauge("p2pin3_request_queue_depth", "Block requests not answered yet, by us when uploading.",
+		float64(downloadQueue), "infohash", infoHash, "direction", "download")
+	w.Gauge("p2pin3_request_queue_depth", "Block requests not answered yet, by us when uploading.",
+		float64(uploadQueue), "infohash", infoHash, "direction", "upload")
+
+	tracker := t.tracker
+	if seed, ok := s.Registry.Lookup(t.File.InfoHash); ok && info.Status == StatusSeeding.String() {
+		tracker = seed.Tracker
+	}
+	tracker.WriteMetrics(w, infoHash)
+}
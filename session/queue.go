@@ -0,0 +1,171 @@
+package session
+
+import (
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/library"
+)
+
+// Queue returns every torrent of the session in queue order: when slots
+// free up, queued torrents start in this order
+func (s *Session) Queue() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Torrent(nil), s.queue...)
+}
+
+// QueuePosition returns the position of a torrent in the queue, from 0
+func (s *Session) QueuePosition(t *Torrent) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position(t)
+}
+
+// position is QueuePosition for callers holding s.mu, -1 for a removed
+// torrent
+func (s *Session) position(t *Torrent) int {
+	for i, q := range s.queue {
+		if q == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// MoveQueue moves a torrent to a position of the queue, from 0; positions
+// past the end move it last. Torrents already running keep running, the
+// new order applies when slots free up or the limits are lowered.
+func (s *Session) MoveQueue(id, position int) error {
+	t, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if position < 0 {
+		return fmt.Errorf("queue position %d is negative", position)
+	}
+	s.mu.Lock()
+	s.removeFromQueue(t)
+	if position > len(s.queue) {
+		position = len(s.queue)
+	}
+	s.queue = append(s.queue, nil)
+	copy(s.queue[position+1:], s.queue[position:])
+	s.queue[position] = t
+	s.mu.Unlock()
+
+	err = s.saveQueue()
+	if err != nil {
+		return err
+	}
+	s.schedule()
+	return nil
+}
+
+// removeFromQueue takes a torrent out of the queue. The caller holds s.mu.
+func (s *Session) removeFromQueue(t *Torrent) {
+	if i := s.position(t); i >= 0 {
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	}
+}
+
+// saveQueue records the queue position of every torrent in the library
+func (s *Session) saveQueue() error {
+	positions := make(map[[20]byte]int)
+	for i, t := range s.Queue() {
+		positions[t.File.InfoHash] = i
+	}
+	return s.db.Update(func(entries map[[20]byte]*library.Entry) error {
+		for infoHash, e := range entries {
+			if position, ok := positions[infoHash]; ok {
+				e.QueuePosition = position
+			}
+		}
+		return nil
+	})
+}
+
+// schedule starts queued torrents while there is room for them, and queues
+// active ones again when there are more than the limits allow. Torrents are
+// taken in queue order.
+func (s *Session) schedule() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.mu.Lock()
+	maxDownloads, maxSeeds := s.maxDownloads, s.maxSeeds
+	s.mu.Unlock()
+
+	var downloading, downloadQueue, seeding, seedQueue []*Torrent
+	for _, t := range s.Queue() {
+		status, _ := t.Status()
+		switch status {
+		case StatusDownloading:
+			downloading = append(downloading, t)
+		case StatusQueued:
+			downloadQueue = append(downloadQueue, t)
+		case StatusSeeding:
+			seeding = append(seeding, t)
+		case StatusSeedQueued:
+			seedQueue = append(seedQueue, t)
+		}
+	}
+
+	// The limits were lowered: queue the last torrents again
+	for maxDownloads > 0 && len(downloading) > maxDownloads {
+		s.requeue(downloading[len(downloading)-1])
+		downloading = downloading[:len(downloading)-1]
+	}
+	for maxSeeds > 0 && len(seeding) > maxSeeds {
+		s.unseed(seeding[len(seeding)-1])
+		seeding = seeding[:len(seeding)-1]
+	}
+
+	for _, t := range downloadQueue {
+		if maxDownloads > 0 && len(downloading) >= maxDownloads {
+			break
+		}
+		s.start(t)
+		downloading = append(downloading, t)
+	}
+	for _, t := range seedQueue {
+		if maxSeeds > 0 && len(seeding) >= maxSeeds {
+			break
+		}
+		s.seed(t)
+		seeding = append(seeding, t)
+	}
+}
+
+// requeue stops a download without waiting for it and puts it back in the
+// queue
+func (s *Session) requeue(t *Torrent) {
+	t.mu.Lock()
+	t.status = StatusQueued
+	cancel := t.cancel
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// seed serves a complete torrent
+func (s *Session) seed(t *Torrent) {
+	t.mu.Lock()
+	t.status = StatusSeeding
+	t.mu.Unlock()
+	if !s.Registry.Has(t.File.InfoHash) {
+		s.Registry.Add(t.File, t.Path)
+	}
+}
+
+// unseed stops serving a complete torrent and puts it back in the queue
+func (s *Session) unseed(t *Torrent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = StatusSeedQueued
+	if seed, ok := s.Registry.Lookup(t.File.InfoHash); ok {
+		t.uploaded += seed.Uploaded.Load()
+		s.Registry.Remove(t.File.InfoHash)
+	}
+}
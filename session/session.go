@@ -0,0 +1,849 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/connlimit"
+	"github.com/lvkeliang/P2Pin3/hooks"
+	"github.com/lvkeliang/P2Pin3/library"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/ratelimit"
+	"github.com/lvkeliang/P2Pin3/seeder"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"github.com/lvkeliang/P2Pin3/tracker"
+	"github.com/lvkeliang/P2Pin3/wiretrace"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var logger = logging.For(logging.Session)
+
+var (
+	// ErrNotFound is returned for an unknown torrent ID
+	ErrNotFound = errors.New("no such torrent")
+	// ErrExists is returned when adding a torrent that is already there
+	ErrExists = errors.New("torrent already added")
+)
+
+// Config holds where a session keeps its data and the limits it applies
+// to all of its torrents together
+type Config struct {
+	DownloadDir string
+	LibraryPath string
+	TorrentDir  string // metainfo of entries migrated from a hashmap.json
+
+	// ListenAddr is where peers connect to download the seeded torrents,
+	// like ":6881". Nothing is served when it is empty.
+	ListenAddr string
+	// AnnounceInterval is how often the seeds are announced to their
+	// trackers, tracker.DefaultInterval when zero
+	AnnounceInterval time.Duration
+
+	// MaxConns caps the connections to peers, MaxHalfOpen the ones being
+	// dialed among them; zero means unlimited
+	MaxConns    int
+	MaxHalfOpen int
+
+	// MaxActiveDownloads and MaxActiveSeeds cap how many torrents download
+	// and seed at once, the others wait in the queue; zero means unlimited
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+
+	// DownloadLimit and UploadLimit cap the rates in bytes per second;
+	// zero means unlimited
+	DownloadLimit int64
+	UploadLimit   int64
+
+	// AltDownloadLimit and AltUploadLimit apply instead while the
+	// alternate speed is on, by hand or within AltSchedule
+	AltDownloadLimit int64
+	AltUploadLimit   int64
+	AltSchedule      *Schedule
+
+	// Hooks, when set, are told about every download that completes
+	Hooks *hooks.Runner
+
+	// Trace, when set, records the messages of every peer connection
+	Trace *wiretrace.Tracer
+
+	// Storage is how downloads are written and seeds read, plain files
+	// when empty
+	Storage storage.Backend
+}
+
+// Session runs many torrents at once: downloads in the background and
+// complete torrents through its seeder registry, served on its own listener
+// under a single peer ID. Connections and bandwidth are shared between the
+// torrents, and torrents past the active limits wait in a queue. Its state
+// is kept in the library so that a new session picks up where the last one
+// stopped.
+type Session struct {
+	Registry      *seeder.Registry
+	PeerID        [20]byte
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+	Conns         *connlimit.Limiter
+
+	cfg      Config
+	db       *library.DB
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	// queueMu serializes schedule and requeueMissing
+	queueMu sync.Mutex
+
+	mu           sync.Mutex
+	torrents     map[int]*Torrent
+	queue        []*Torrent // every torrent, in queue order
+	nextID       int
+	maxDownloads int
+	maxSeeds     int
+
+	// The limits set by the user; the rate limiters hold the ones that
+	// apply, see applyLimits
+	downloadLimit    int64
+	uploadLimit      int64
+	altDownloadLimit int64
+	altUploadLimit   int64
+	altSpeed         bool
+	altSchedule      *Schedule
+}
+
+// Stats sums up the torrents of a session
+type Stats struct {
+	Torrents      int     `json:"torrents"`
+	Downloading   int     `json:"downloading"`
+	Seeding       int     `json:"seeding"`
+	Stopped       int     `json:"stopped"`
+	Queued        int     `json:"queued"`       // downloads and seeds waiting for a slot
+	DownloadRate  float64 `json:"downloadRate"` // bytes per second
+	UploadRate    float64 `json:"uploadRate"`   // bytes per second
+	Downloaded    int64   `json:"downloaded"`
+	Uploaded      int64   `json:"uploaded"`
+	DownloadLimit int64   `json:"downloadLimit"` // bytes per second, 0 for none
+	UploadLimit   int64   `json:"uploadLimit"`
+
+	// AltSpeed tells if the alternate limits apply instead of the ones
+	// above, AltSpeedOn if it was turned on by hand
+	AltSpeed         bool      `json:"altSpeed"`
+	AltSpeedOn       bool      `json:"altSpeedOn"`
+	AltDownloadLimit int64     `json:"altDownloadLimit"`
+	AltUploadLimit   int64     `json:"altUploadLimit"`
+	AltSchedule      *Schedule `json:"altSchedule,omitempty"`
+
+	Conns              int `json:"conns"`
+	HalfOpen           int `json:"halfOpen"`
+	MaxConns           int `json:"maxConns"`
+	MaxHalfOpen        int `json:"maxHalfOpen"`
+	MaxActiveDownloads int `json:"maxActiveDownloads"`
+	MaxActiveSeeds     int `json:"maxActiveSeeds"`
+}
+
+// New creates a session, starts listening for peers and restores the
+// torrents of its library: complete ones are seeded and downloads that were
+// not paused resume.
+func New(cfg Config) (*Session, error) {
+	err := os.MkdirAll(cfg.DownloadDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := library.Open(cfg.LibraryPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AnnounceInterval <= 0 {
+		cfg.AnnounceInterval = tracker.DefaultInterval
+	}
+	if cfg.AltSchedule != nil {
+		err = cfg.AltSchedule.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("alternate speed schedule: %w", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		Registry:      seeder.NewRegistry(),
+		DownloadLimit: ratelimit.New(0),
+		UploadLimit:   ratelimit.New(0),
+		Conns:         connlimit.New(cfg.MaxConns, cfg.MaxHalfOpen),
+		cfg:           cfg,
+		db:            db,
+		ctx:           ctx,
+		cancel:        cancel,
+		torrents:      make(map[int]*Torrent),
+		nextID:        1,
+		maxDownloads:  cfg.MaxActiveDownloads,
+		maxSeeds:      cfg.MaxActiveSeeds,
+
+		downloadLimit:    cfg.DownloadLimit,
+		uploadLimit:      cfg.UploadLimit,
+		altDownloadLimit: cfg.AltDownloadLimit,
+		altUploadLimit:   cfg.AltUploadLimit,
+		altSchedule:      cfg.AltSchedule,
+	}
+	s.Registry.Storage = cfg.Storage
+	s.applyLimits()
+	_, err = rand.Read(s.PeerID[:])
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if cfg.ListenAddr != "" {
+		s.listener, err = net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	err = s.restore()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.listener != nil {
+		s.serve()
+	}
+	s.wg.Add(2)
+	go s.followSchedule()
+	go func() {
+		defer s.wg.Done()
+		s.Registry.MeasureRates(s.ctx, rateInterval)
+	}()
+	return s, nil
+}
+
+// serve seeds the registry on the listener and announces it
+func (s *Session) serve() {
+	server := &seeder.Server{
+		Registry:    s.Registry,
+		PeerID:      s.PeerID,
+		UploadLimit: s.UploadLimit,
+		Conns:       s.Conns,
+		Trace:       s.cfg.Trace,
+	}
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		err := server.Serve(s.listener)
+		if err != nil && s.ctx.Err() == nil {
+			logger.Error("seeder stopped", logging.Err(err))
+		}
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.Registry.Announce(s.ctx, s.PeerID, uint16(port), s.cfg.AnnounceInterval)
+	}()
+}
+
+// Addr returns where the session listens for peers, nil if it does not
+func (s *Session) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Session) restore() error {
+	err := s.Registry.Load(s.cfg.LibraryPath, s.cfg.TorrentDir)
+	if err != nil {
+		return err
+	}
+	entries, err := s.db.All()
+	if err != nil {
+		return err
+	}
+
+	// Restore the torrents in queue order, which also gives their IDs
+	infoHashes := make([][20]byte, 0, len(entries))
+	for infoHash := range entries {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	sort.Slice(infoHashes, func(i, j int) bool {
+		a, b := entries[infoHashes[i]], entries[infoHashes[j]]
+		if a.QueuePosition != b.QueuePosition {
+			return a.QueuePosition < b.QueuePosition
+		}
+		return a.Added.Before(b.Added)
+	})
+	for _, infoHash := range infoHashes {
+		e := entries[infoHash]
+		if seed, ok := s.Registry.Lookup(infoHash); ok {
+			t := s.newTorrent(seed.Torrent, seed.Path, StatusSeeding)
+			t.Added = e.Added
+			t.downloaded = e.Downloaded
+			continue
+		}
+		if e.Complete() {
+			continue
+		}
+		tf, err := torrent.FromEntry(e)
+		if err != nil {
+			logger.Warn("cannot restore torrent", "name", e.Name, logging.Err(err))
+			continue
+		}
+		status := StatusQueued
+		if e.Paused {
+			status = StatusStopped
+		}
+		t := s.newTorrent(&tf, e.Path, status)
+		t.Added = e.Added
+		t.downloaded = e.Downloaded
+		for _, p := range e.FilePriorities {
+			t.priorities = append(t.priorities, protocol.FilePriority(p))
+		}
+	}
+	// Seeds found in the torrent directory have no entry, they go last
+	for _, seed := range s.Registry.Seeds() {
+		if entries[seed.Torrent.InfoHash] == nil {
+			s.newTorrent(seed.Torrent, seed.Path, StatusSeeding)
+		}
+	}
+	s.schedule()
+	return nil
+}
+
+// newTorrent registers a torrent under a new ID
+func (s *Session) newTorrent(tf *torrent.TorrentFile, path string, status Status) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(tf, path, status)
+}
+
+// insert is newTorrent for callers holding s.mu
+func (s *Session) insert(tf *torrent.TorrentFile, path string, status Status) *Torrent {
+	t := &Torrent{
+		ID:     s.nextID,
+		File:   tf,
+		Path:   path,
+		Added:  time.Now(),
+		status: status,
+
+		tracker: torrent.NewTracker(tf),
+	}
+	s.nextID++
+	s.torrents[t.ID] = t
+	s.queue = append(s.queue, t)
+	return t
+}
+
+// Add starts downloading a torrent into the download directory, or only
+// records it when paused is set
+func (s *Session) Add(tf *torrent.TorrentFile, paused bool) (*Torrent, error) {
+	// The metainfo comes from whoever sent it; a path in its name or files
+	// would save, and later delete, data outside of DownloadDir
+	err := tf.Validate()
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.add(tf, paused)
+	if err != nil {
+		return nil, err
+	}
+	err = s.saveQueue()
+	if err != nil {
+		return nil, err
+	}
+	s.schedule()
+	return t, nil
+}
+
+// add records a new torrent in the library and the session. The torrent is
+// looked up and inserted under s.mu, so that of two adds of the same
+// torrent, say from the RPC and the inbox, only one starts a download.
+func (s *Session) add(tf *torrent.TorrentFile, paused bool) (*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookup(tf.InfoHash) != nil {
+		return nil, ErrExists
+	}
+	path := filepath.Join(s.cfg.DownloadDir, tf.Name)
+	err := tf.Record(s.cfg.LibraryPath, path, func(e *library.Entry) {
+		e.Paused = paused
+	})
+	if err != nil {
+		return nil, err
+	}
+	status := StatusQueued
+	if paused {
+		status = StatusStopped
+	}
+	return s.insert(tf, path, status), nil
+}
+
+// AddMagnet adds the torrent of a magnet link. Its metadata must be known
+// to the library or the torrent directory, see torrent.ResolveMagnet.
+func (s *Session) AddMagnet(uri string, paused bool) (*Torrent, error) {
+	tf, err := torrent.ResolveMagnet(uri, s.cfg.LibraryPath, s.cfg.TorrentDir)
+	if err != nil {
+		return nil, err
+	}
+	return s.Add(tf, paused)
+}
+
+// DownloadDir returns where new torrents are downloaded
+func (s *Session) DownloadDir() string {
+	return s.cfg.DownloadDir
+}
+
+// Get returns the torrent with an ID
+func (s *Session) Get(id int) (*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[id]
+	if !ok {
+		return nil, fmt.Errorf("torrent %d: %w", id, ErrNotFound)
+	}
+	return t, nil
+}
+
+// Lookup returns the torrent with an infohash, nil if there is none
+func (s *Session) Lookup(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(infoHash)
+}
+
+// lookup is Lookup for callers holding s.mu
+func (s *Session) lookup(infoHash [20]byte) *Torrent {
+	for _, t := range s.torrents {
+		if t.File.InfoHash == infoHash {
+			return t
+		}
+	}
+	return nil
+}
+
+// Torrents returns every torrent of the session, by ID
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].ID < torrents[j].ID })
+	return torrents
+}
+
+// Info returns a snapshot of a torrent
+func (s *Session) Info(t *Torrent) Info {
+	var uploaded int64
+	seed, ok := s.Registry.Lookup(t.File.InfoHash)
+	if ok {
+		uploaded = seed.Uploaded.Load()
+	}
+	info := t.info(uploaded)
+	info.QueuePosition = s.QueuePosition(t)
+	if ok && info.Status == StatusSeeding.String() {
+		info.UploadRate = seed.UploadRate()
+		info.Tracker = seed.Tracker.Status()
+	}
+	return info
+}
+
+// Peers returns the connections of a torrent: the peers it downloads from
+// and the ones downloading it from the seeder
+func (s *Session) Peers(t *Torrent) []PeerInfo {
+	var peers []PeerInfo
+	t.mu.Lock()
+	dl := t.dl
+	if t.status != StatusDownloading {
+		dl = nil
+	}
+	t.mu.Unlock()
+	if dl != nil {
+		for _, p := range dl.PeerStats() {
+			peers = append(peers, PeerInfo{
+				Addr:           p.Addr,
+				Direction:      "download",
+				Downloaded:     p.Downloaded,
+				Rate:           p.Rate,
+				Backlog:        p.Backlog,
+				Choked:         p.Choked,
+				Interested:     p.Interested,
+				PeerInterested: p.PeerInterested,
+			})
+		}
+	}
+	if seed, ok := s.Registry.Lookup(t.File.InfoHash); ok {
+		for _, p := range seed.Peers() {
+			peers = append(peers, PeerInfo{
+				Addr:           p.Addr,
+				Direction:      "upload",
+				Uploaded:       p.Uploaded,
+				Backlog:        p.Pending,
+				PeerInterested: p.Interested,
+			})
+		}
+	}
+	return peers
+}
+
+// Start resumes a stopped or failed download. It waits in the queue when
+// the active downloads are at their limit.
+func (s *Session) Start(id int) error {
+	t, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	status, _ := t.Status()
+	if status != StatusStopped && status != StatusError {
+		return nil
+	}
+	err = s.update(t, func(e *library.Entry) { e.Paused = false })
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.status = StatusQueued
+	t.err = nil
+	t.mu.Unlock()
+	s.schedule()
+	return nil
+}
+
+// Stop pauses a download, or takes it out of the queue. Data already
+// downloaded is kept.
+func (s *Session) Stop(id int) error {
+	t, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	status, _ := t.Status()
+	if status == StatusSeeding || status == StatusSeedQueued {
+		return nil
+	}
+	s.stop(t)
+	t.mu.Lock()
+	if t.status == StatusQueued || t.status == StatusDownloading {
+		t.status = StatusStopped
+	}
+	t.mu.Unlock()
+	s.schedule()
+	return s.update(t, func(e *library.Entry) { e.Paused = true })
+}
+
+// Remove drops a torrent from the session and the library, and deletes its
+// data when deleteData is set. Only data in the download directory is
+// deleted: seeds restored from the library are read from wherever the user
+// keeps them, so removing one with deleteData fails and leaves it as it is.
+func (s *Session) Remove(id int, deleteData bool) error {
+	t, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if deleteData && !s.downloaded(t) {
+		return fmt.Errorf("torrent %d: %s is outside of the download directory, not deleting it", id, t.Path)
+	}
+	s.stop(t)
+	s.Registry.Remove(t.File.InfoHash)
+	s.mu.Lock()
+	delete(s.torrents, id)
+	s.removeFromQueue(t)
+	s.mu.Unlock()
+	s.schedule()
+
+	err = s.db.Delete(t.File.InfoHash)
+	if err != nil {
+		return err
+	}
+	err = s.saveQueue()
+	if err != nil {
+		return err
+	}
+	if !deleteData {
+		return nil
+	}
+	if len(t.File.Files) > 0 {
+		return os.RemoveAll(t.Path)
+	}
+	err = os.Remove(t.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(t.Path + storage.PartSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// downloaded tells if the data of a torrent is in the download directory
+func (s *Session) downloaded(t *Torrent) bool {
+	dir, err := filepath.Abs(s.cfg.DownloadDir)
+	if err != nil {
+		return false
+	}
+	path, err := filepath.Abs(t.Path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && filepath.IsLocal(rel)
+}
+
+// SetFilePriority changes the priority of a file of a torrent, taking
+// effect right away if it is downloading
+func (s *Session) SetFilePriority(id, file int, p protocol.FilePriority) error {
+	t, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	n := len(t.File.Files)
+	if n == 0 {
+		n = 1
+	}
+	if file < 0 || file >= n {
+		return fmt.Errorf("file index %d out of range [0, %d)", file, n)
+	}
+
+	t.mu.Lock()
+	for len(t.priorities) < n {
+		t.priorities = append(t.priorities, protocol.PriorityNormal)
+	}
+	t.priorities[file] = p
+	priorities := make([]int, len(t.priorities))
+	for i, p := range t.priorities {
+		priorities[i] = int(p)
+	}
+	dl := t.dl
+	running := t.status == StatusDownloading
+	t.mu.Unlock()
+
+	if dl != nil && running {
+		err = dl.SetFilePriority(file, p)
+		if err != nil {
+			return err
+		}
+	}
+	requeued := s.requeueMissing(t)
+	return s.update(t, func(e *library.Entry) {
+		e.FilePriorities = priorities
+		if requeued {
+			e.Completed = time.Time{}
+		}
+	})
+}
+
+// requeueMissing stops seeding a torrent that is missing wanted pieces, a
+// file that was skipped being wanted again, and queues it to download them.
+// It tells if the torrent was queued.
+func (s *Session) requeueMissing(t *Torrent) bool {
+	s.queueMu.Lock()
+	t.mu.Lock()
+	requeue := (t.status == StatusSeeding || t.status == StatusSeedQueued) && t.missing()
+	if requeue {
+		t.status = StatusQueued
+		if seed, ok := s.Registry.Lookup(t.File.InfoHash); ok {
+			t.uploaded += seed.Uploaded.Load()
+			s.Registry.Remove(t.File.InfoHash)
+		}
+	}
+	t.mu.Unlock()
+	s.queueMu.Unlock()
+	if requeue {
+		s.schedule()
+	}
+	return requeue
+}
+
+// SetConnLimits changes how many connections every torrent may have
+// together, and how many of them may be dialing; zero removes a limit
+func (s *Session) SetConnLimits(maxConns, maxHalfOpen int) {
+	s.Conns.SetLimits(maxConns, maxHalfOpen)
+}
+
+// SetActiveLimits changes how many torrents may download and seed at once;
+// zero removes a limit. Torrents past a lowered limit go back to the queue.
+func (s *Session) SetActiveLimits(downloads, seeds int) {
+	s.mu.Lock()
+	s.maxDownloads, s.maxSeeds = downloads, seeds
+	s.mu.Unlock()
+	s.schedule()
+}
+
+// Stats sums up every torrent of the session
+func (s *Session) Stats() Stats {
+	var st Stats
+	st.Conns, st.HalfOpen = s.Conns.Counts()
+	st.MaxConns, st.MaxHalfOpen = s.Conns.Limits()
+	s.mu.Lock()
+	st.MaxActiveDownloads, st.MaxActiveSeeds = s.maxDownloads, s.maxSeeds
+	st.DownloadLimit, st.UploadLimit = s.downloadLimit, s.uploadLimit
+	st.AltSpeed = s.altActive(time.Now())
+	st.AltSpeedOn = s.altSpeed
+	st.AltDownloadLimit, st.AltUploadLimit = s.altDownloadLimit, s.altUploadLimit
+	if s.altSchedule != nil {
+		sc := *s.altSchedule
+		st.AltSchedule = &sc
+	}
+	s.mu.Unlock()
+	for _, t := range s.Torrents() {
+		info := s.Info(t)
+		st.Torrents++
+		switch info.Status {
+		case StatusDownloading.String():
+			st.Downloading++
+		case StatusSeeding.String():
+			st.Seeding++
+		case StatusQueued.String(), StatusSeedQueued.String():
+			st.Queued++
+		default:
+			st.Stopped++
+		}
+		st.DownloadRate += info.DownloadRate
+		st.UploadRate += info.UploadRate
+		st.Downloaded += info.Downloaded
+		st.Uploaded += info.Uploaded
+	}
+	return st
+}
+
+// Close stops every download and stops seeding, then waits for all of
+// them to return
+func (s *Session) Close() {
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+}
+
+// update changes the library entry of a torrent
+func (s *Session) update(t *Torrent, fn func(e *library.Entry)) error {
+	return s.db.Update(func(entries map[[20]byte]*library.Entry) error {
+		e := entries[t.File.InfoHash]
+		if e == nil {
+			return nil
+		}
+		fn(e)
+		return nil
+	})
+}
+
+// start runs the download of a torrent in the background
+func (s *Session) start(t *Torrent) {
+	t.mu.Lock()
+	if t.cancel != nil {
+		t.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	t.cancel = cancel
+	t.done = done
+	t.status = StatusDownloading
+	t.err = nil
+	t.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := s.run(ctx, t)
+		s.finish(ctx, t, err)
+		close(done)
+		s.schedule()
+	}()
+}
+
+// finish records how the download of a torrent ended. A complete torrent
+// waits in the queue until schedule seeds it.
+func (s *Session) finish(ctx context.Context, t *Torrent, err error) {
+	t.mu.Lock()
+	completed := false
+	t.cancel = nil
+	if t.dl != nil {
+		stats := t.dl.Stats()
+		t.downloaded += stats.Downloaded
+		t.verified += stats.Verified
+		t.hashFailed += stats.HashFailed
+	}
+	switch {
+	case err == nil && t.missing():
+		// A skipped file was wanted again as the download returned
+		t.status = StatusQueued
+	case err == nil:
+		t.status = StatusSeedQueued
+		completed = true
+	case ctx.Err() != nil:
+		// Put back in the queue by schedule, or stopped
+		if t.status != StatusQueued {
+			t.status = StatusStopped
+		}
+	default:
+		logger.Error("download failed", logging.InfoHash(t.File.InfoHash), logging.Err(err))
+		t.status = StatusError
+		t.err = err
+	}
+	t.mu.Unlock()
+
+	// Hooks are told without holding t.mu, which Info and Peers wait for
+	if completed {
+		s.cfg.Hooks.Fire(s.ctx, hooks.Completed(t.File, t.Path))
+	}
+}
+
+func (s *Session) run(ctx context.Context, t *Torrent) error {
+	t.mu.Lock()
+	st := t.storage
+	priorities := append([]protocol.FilePriority(nil), t.priorities...)
+	t.mu.Unlock()
+	if st == nil {
+		// Pick up the data a previous session left behind
+		var err error
+		st, err = s.cfg.Storage.Create(t.Path, t.File.Layout())
+		if err != nil {
+			return err
+		}
+		_, err = storage.Verify(st, t.File.Layout(), t.File.PieceHashes)
+		if err != nil {
+			st.Close()
+			return err
+		}
+		t.mu.Lock()
+		t.storage = st
+		t.mu.Unlock()
+	}
+
+	start := time.Now()
+	dl, err := t.File.NewDownloadAs(ctx, s.PeerID)
+	if err != nil {
+		if ctx.Err() == nil {
+			t.tracker.Record(0, time.Since(start), err)
+		}
+		return err
+	}
+	t.tracker.Follow(dl)
+	dl.Storage = st
+	dl.FilePriorities = priorities
+	dl.DownloadLimit = s.DownloadLimit
+	dl.Conns = s.Conns
+	dl.Trace = s.cfg.Trace
+	t.mu.Lock()
+	t.dl = dl
+	t.mu.Unlock()
+	return t.File.RunDownload(ctx, dl, t.Path, s.cfg.LibraryPath)
+}
+
+// stop cancels the download of a torrent and waits for it to return
+func (s *Session) stop(t *Torrent) {
+	t.mu.Lock()
+	cancel, done := t.cancel, t.done
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
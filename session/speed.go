@@ -0,0 +1,168 @@
+package session
+
+import (
+	"fmt"
+	"time"
+)
+
+// scheduleInterval is how often the alternate speed schedule is checked
+const scheduleInterval = 30 * time.Second
+
+// rateInterval is how often the upload rates of the seeds are sampled, as
+// often as downloads sample theirs
+const rateInterval = time.Second
+
+// Schedule is a time window repeated every week, like 08:00 to 18:00 on
+// weekdays. It wraps past midnight when End is before Begin.
+type Schedule struct {
+	Begin string         `json:"begin"` // like "08:00"
+	End   string         `json:"end"`
+	Days  []time.Weekday `json:"days,omitempty"` // when the window begins, every day when empty
+}
+
+// Validate checks the times of the schedule
+func (sc *Schedule) Validate() error {
+	_, err := parseClock(sc.Begin)
+	if err != nil {
+		return err
+	}
+	_, err = parseClock(sc.End)
+	if err != nil {
+		return err
+	}
+	for _, d := range sc.Days {
+		if d < time.Sunday || d > time.Saturday {
+			return fmt.Errorf("invalid weekday %d", d)
+		}
+	}
+	return nil
+}
+
+// Active tells if now falls within the window. An invalid schedule is
+// never active.
+func (sc *Schedule) Active(now time.Time) bool {
+	begin, err := parseClock(sc.Begin)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(sc.End)
+	if err != nil {
+		return false
+	}
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	switch {
+	case begin <= end:
+		return begin <= clock && clock < end && sc.on(now.Weekday())
+	case clock >= begin:
+		return sc.on(now.Weekday())
+	case clock < end:
+		// In the part after midnight of a window that began the day before
+		return sc.on((now.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+func (sc *Schedule) on(day time.Weekday) bool {
+	if len(sc.Days) == 0 {
+		return true
+	}
+	for _, d := range sc.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses a time of day like "08:00" into the time since midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want hh:mm", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// SetLimits changes the download and upload limits shared by every torrent,
+// in bytes per second; zero removes a limit. They apply unless the
+// alternate limits do.
+func (s *Session) SetLimits(download, upload int64) {
+	s.mu.Lock()
+	s.downloadLimit, s.uploadLimit = download, upload
+	s.mu.Unlock()
+	s.applyLimits()
+}
+
+// SetAltLimits changes the alternate limits, which apply instead of the
+// usual ones while the alternate speed is on
+func (s *Session) SetAltLimits(download, upload int64) {
+	s.mu.Lock()
+	s.altDownloadLimit, s.altUploadLimit = download, upload
+	s.mu.Unlock()
+	s.applyLimits()
+}
+
+// SetAltSpeed turns the alternate speed on or off by hand. It is also on
+// within the alternate speed schedule, whatever this says.
+func (s *Session) SetAltSpeed(on bool) {
+	s.mu.Lock()
+	s.altSpeed = on
+	s.mu.Unlock()
+	s.applyLimits()
+}
+
+// SetAltSchedule changes when the alternate speed turns on by itself; nil
+// removes the schedule
+func (s *Session) SetAltSchedule(sc *Schedule) error {
+	if sc != nil {
+		err := sc.Validate()
+		if err != nil {
+			return err
+		}
+		copied := *sc
+		copied.Days = append([]time.Weekday(nil), sc.Days...)
+		sc = &copied
+	}
+	s.mu.Lock()
+	s.altSchedule = sc
+	s.mu.Unlock()
+	s.applyLimits()
+	return nil
+}
+
+// applyLimits sets the rate limiters to the limits that apply now
+func (s *Session) applyLimits() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	download, upload := s.downloadLimit, s.uploadLimit
+	if s.altActive(time.Now()) {
+		download, upload = s.altDownloadLimit, s.altUploadLimit
+	}
+	if s.DownloadLimit.Rate() != download {
+		s.DownloadLimit.SetRate(download)
+	}
+	if s.UploadLimit.Rate() != upload {
+		s.UploadLimit.SetRate(upload)
+	}
+}
+
+// altActive tells if the alternate limits apply. The caller holds s.mu.
+func (s *Session) altActive(now time.Time) bool {
+	return s.altSpeed || s.altSchedule != nil && s.altSchedule.Active(now)
+}
+
+// followSchedule applies the limits as the schedule turns the alternate
+// speed on and off, until the session closes
+func (s *Session) followSchedule() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.applyLimits()
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package session
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/storage"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"sync"
+	"time"
+)
+
+// Status is what a torrent of the session is doing
+type Status int
+
+const (
+	// StatusStopped is a download paused by the user
+	StatusStopped Status = iota
+	// StatusDownloading is a download in progress
+	StatusDownloading
+	// StatusSeeding is a complete torrent being seeded
+	StatusSeeding
+	// StatusError is a download that failed; it can be resumed
+	StatusError
+	// StatusQueued is a download waiting for a slot
+	StatusQueued
+	// StatusSeedQueued is a complete torrent waiting for a slot to seed
+	StatusSeedQueued
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusStopped:
+		return "stopped"
+	case StatusDownloading:
+		return "downloading"
+	case StatusSeeding:
+		return "seeding"
+	case StatusError:
+		return "error"
+	case StatusQueued:
+		return "queued"
+	case StatusSeedQueued:
+		return "seed-queued"
+	default:
+		return "unknown"
+	}
+}
+
+// Torrent is a torrent managed by the session
+type Torrent struct {
+	ID    int
+	File  *torrent.TorrentFile
+	Path  string // where the data is stored
+	Added time.Time
+
+	mu         sync.Mutex
+	status     Status
+	err        error
+	priorities []protocol.FilePriority
+	storage    storage.Storage    // kept across pauses, nil until started
+	dl         *protocol.Torrent  // the running or last download
+	downloaded int64              // by the downloads before dl
+	verified   int                // pieces verified by the downloads before dl
+	hashFailed int                // pieces failed by the downloads before dl
+	uploaded   int64              // by the seeds before the current one
+	cancel     context.CancelFunc // stops the running download
+	done       chan struct{}      // closed once the running download returns
+	tracker    *torrent.Tracker   // announces of the downloads
+}
+
+// Info is a snapshot of a torrent of the session
+type Info struct {
+	ID           int        `json:"id"`
+	InfoHash     string     `json:"infoHash"`
+	Name         string     `json:"name"`
+	Path         string     `json:"path"`
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	Length       int64      `json:"length"`
+	PiecesDone   int        `json:"piecesDone"`
+	PiecesTotal  int        `json:"piecesTotal"`
+	BytesDone    int64      `json:"bytesDone"`
+	BytesTotal   int64      `json:"bytesTotal"`
+	Percent      float64    `json:"percent"`
+	DownloadRate float64    `json:"downloadRate"` // bytes per second
+	UploadRate   float64    `json:"uploadRate"`   // bytes per second, while seeding
+	ETA          int64      `json:"eta"`          // seconds, 0 when unknown
+	Downloaded   int64      `json:"downloaded"`
+	Uploaded     int64      `json:"uploaded"`
+	Verified     int        `json:"verified"`   // pieces downloaded and verified
+	HashFailed   int        `json:"hashFailed"` // pieces downloaded that failed their hash check
+	Peers        int        `json:"peers"`
+	Added        time.Time  `json:"added"`
+	Files        []FileInfo `json:"files"`
+
+	// QueuePosition orders the torrents waiting for a slot, from 0
+	QueuePosition int `json:"queuePosition"`
+
+	// Tracker is the last announce of the download, or of the seed once
+	// the torrent is seeding
+	Tracker torrent.TrackerStatus `json:"tracker"`
+
+	// Pieces has a bit set for each of the PieceCount pieces that is there
+	PieceCount int               `json:"pieceCount"`
+	Pieces     bitfield.Bitfield `json:"pieces"`
+}
+
+// FileInfo describes a file of a torrent
+type FileInfo struct {
+	Path      string `json:"path"`
+	Length    int    `json:"length"`
+	BytesDone int64  `json:"bytesDone"`
+	Priority  string `json:"priority"`
+}
+
+// PeerInfo describes a connection of a torrent to a peer
+type PeerInfo struct {
+	Addr           string  `json:"addr"`
+	Direction      string  `json:"direction"` // "download" from the peer or "upload" to it
+	Downloaded     int64   `json:"downloaded"`
+	Uploaded       int64   `json:"uploaded"`
+	Rate           float64 `json:"rate"`           // download rate in bytes per second
+	Backlog        int     `json:"backlog"`        // requests not answered yet, by the peer or by us when uploading
+	Choked         bool    `json:"choked"`         // whether the peer is choking us
+	Interested     bool    `json:"interested"`     // whether we want the peer's pieces
+	PeerInterested bool    `json:"peerInterested"` // whether the peer wants ours
+}
+
+// Status returns what the torrent is doing and, for StatusError, why
+func (t *Torrent) Status() (Status, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status, t.err
+}
+
+// Download returns the running or last download of the torrent, nil if it
+// never ran in this session
+func (t *Torrent) Download() *protocol.Torrent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dl
+}
+
+// Progress returns how much of the wanted data is there
+func (t *Torrent) Progress() protocol.Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress()
+}
+
+// progress is Progress for callers holding t.mu
+func (t *Torrent) progress() protocol.Progress {
+	if t.complete() {
+		return protocol.Progress{
+			PiecesDone:  len(t.File.PieceHashes),
+			PiecesTotal: len(t.File.PieceHashes),
+			BytesDone:   int64(t.File.Length),
+			BytesTotal:  int64(t.File.Length),
+			Downloaded:  t.downloaded,
+			Verified:    t.verified,
+			HashFailed:  t.hashFailed,
+		}
+	}
+	if t.dl != nil && t.status == StatusDownloading {
+		p := t.dl.Stats()
+		p.Downloaded += t.downloaded
+		p.Verified += t.verified
+		p.HashFailed += t.hashFailed
+		return p
+	}
+
+	// Not running: count what the storage holds among the wanted pieces
+	p := protocol.Progress{Downloaded: t.downloaded, Verified: t.verified, HashFailed: t.hashFailed}
+	layout := t.File.Layout()
+	for i := range t.File.PieceHashes {
+		if !t.wanted(layout, i) {
+			continue
+		}
+		size := int64(layout.PieceSize(i))
+		p.PiecesTotal++
+		p.BytesTotal += size
+		if t.storage != nil && t.storage.Completed(i) {
+			p.PiecesDone++
+			p.BytesDone += size
+		}
+	}
+	return p
+}
+
+// wanted tells if a piece belongs to a file that is not skipped
+func (t *Torrent) wanted(layout storage.Layout, piece int) bool {
+	if len(t.File.Files) == 0 {
+		return true
+	}
+	begin := int64(piece) * int64(layout.PieceLength)
+	end := begin + int64(layout.PieceSize(piece))
+	var offset int64
+	for i, f := range t.File.Files {
+		fileEnd := offset + int64(f.Length)
+		if begin < fileEnd && end > offset && t.priority(i) != protocol.PrioritySkip {
+			return true
+		}
+		offset = fileEnd
+	}
+	return false
+}
+
+func (t *Torrent) priority(file int) protocol.FilePriority {
+	if file < len(t.priorities) {
+		return t.priorities[file]
+	}
+	return protocol.PriorityNormal
+}
+
+// info builds the snapshot of the torrent; uploaded comes from the seeder
+func (t *Torrent) info(uploaded int64) Info {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress()
+	info := Info{
+		ID:           t.ID,
+		InfoHash:     hex.EncodeToString(t.File.InfoHash[:]),
+		Name:         t.File.Name,
+		Path:         t.Path,
+		Status:       t.status.String(),
+		Length:       int64(t.File.Length),
+		PiecesDone:   p.PiecesDone,
+		PiecesTotal:  p.PiecesTotal,
+		BytesDone:    p.BytesDone,
+		BytesTotal:   p.BytesTotal,
+		Percent:      p.Percent(),
+		DownloadRate: p.Rate,
+		ETA:          int64(p.ETA / time.Second),
+		Downloaded:   p.Downloaded,
+		Uploaded:     t.uploaded + uploaded,
+		Verified:     p.Verified,
+		HashFailed:   p.HashFailed,
+		Peers:        p.Peers,
+		Added:        t.Added,
+		Tracker:      t.tracker.Status(),
+	}
+	if t.err != nil {
+		info.Error = t.err.Error()
+	}
+	files := t.File.Files
+	if len(files) == 0 {
+		files = []protocol.File{{Path: t.File.Name, Length: t.File.Length}}
+	}
+	info.PieceCount = len(t.File.PieceHashes)
+	info.Pieces = make(bitfield.Bitfield, (len(t.File.PieceHashes)+7)/8)
+	for i := range t.File.PieceHashes {
+		if t.completed(i) {
+			info.Pieces.SetPiece(i)
+		}
+	}
+	var offset int64
+	for i, f := range files {
+		info.Files = append(info.Files, FileInfo{
+			Path:      f.Path,
+			Length:    f.Length,
+			BytesDone: t.bytesDone(offset, offset+int64(f.Length)),
+			Priority:  t.priority(i).String(),
+		})
+		offset += int64(f.Length)
+	}
+	return info
+}
+
+// complete tells if every piece is there, wanted or not. The caller holds
+// t.mu.
+func (t *Torrent) complete() bool {
+	if t.storage == nil {
+		// Only seeds restored from the registry, which have all of their
+		// data, start seeding without a download
+		return t.status == StatusSeeding || t.status == StatusSeedQueued
+	}
+	for i := range t.File.PieceHashes {
+		if !t.storage.Completed(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// missing tells if a wanted piece is not in storage yet, as happens once a
+// skipped file is wanted again. The caller holds t.mu.
+func (t *Torrent) missing() bool {
+	if t.complete() {
+		return false
+	}
+	layout := t.File.Layout()
+	for i := range t.File.PieceHashes {
+		if t.wanted(layout, i) && (t.storage == nil || !t.storage.Completed(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+// completed tells if a piece is there. The caller holds t.mu.
+func (t *Torrent) completed(piece int) bool {
+	if t.complete() {
+		return true
+	}
+	return t.storage != nil && t.storage.Completed(piece)
+}
+
+// bytesDone counts the bytes between begin and end that belong to complete
+// pieces. The caller holds t.mu.
+func (t *Torrent) bytesDone(begin, end int64) int64 {
+	pieceLength := int64(t.File.PieceLength)
+	if pieceLength <= 0 || end <= begin {
+		return 0
+	}
+	var done int64
+	for piece := begin / pieceLength; piece*pieceLength < end; piece++ {
+		if !t.completed(int(piece)) {
+			continue
+		}
+		from, to := piece*pieceLength, (piece+1)*pieceLength
+		if from < begin {
+			from = begin
+		}
+		if to > end {
+			to = end
+		}
+		done += to - from
+	}
+	return done
+}
@@ -0,0 +1,44 @@
+package storage
+
+import "fmt"
+
+// Backend names a kind of storage for the data of torrents
+type Backend string
+
+const (
+	// BackendFile keeps data in plain files, named with PartSuffix until
+	// they are complete
+	BackendFile Backend = "file"
+	// BackendMmap maps the files into memory, creating them at their full
+	// size right away, named with PartSuffix until they are complete
+	BackendMmap Backend = "mmap"
+)
+
+// ParseBackend returns the backend named s; empty means BackendFile
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case "":
+		return BackendFile, nil
+	case BackendFile, BackendMmap:
+		return b, nil
+	}
+	return "", fmt.Errorf("unknown storage %q, want file or mmap", s)
+}
+
+// Create returns read-write storage for a torrent at path, to download it.
+// The zero Backend is BackendFile.
+func (b Backend) Create(path string, layout Layout) (Storage, error) {
+	if b == BackendMmap {
+		return NewMmap(path, layout)
+	}
+	return NewPartFile(path, layout), nil
+}
+
+// Open returns read-only storage over the data of a torrent at path, to
+// seed it. The zero Backend is BackendFile.
+func (b Backend) Open(path string, layout Layout) (Storage, error) {
+	if b == BackendMmap {
+		return OpenMmap(path, layout)
+	}
+	return OpenFile(path, layout), nil
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PartSuffix is appended to the name of files that are still incomplete
+const PartSuffix = ".part"
+
+// FileStorage stores a torrent in plain files: the file at path for a
+// single-file torrent, the files under the directory at path otherwise.
+// Files are opened when first used and created when first written.
+type FileStorage struct {
+	completion
+	layout   Layout
+	path     string
+	readOnly bool
+	suffix   string
+
+	mu        sync.Mutex
+	files     []*os.File
+	finalized []bool
+}
+
+// NewFile creates read-write storage at path
+func NewFile(path string, layout Layout) *FileStorage {
+	return &FileStorage{
+		completion: newCompletion(layout.NumPieces()),
+		layout:     layout,
+		path:       path,
+		files:      make([]*os.File, len(layout.files())),
+		finalized:  make([]bool, len(layout.files())),
+	}
+}
+
+// NewPartFile creates read-write storage at path that keeps every file under
+// a temporary name ending in PartSuffix until Finalize moves it into place,
+// so nothing watching path sees partial data. Files found under their final
+// name only, moved there by an earlier download, are read where they are,
+// for Verify to find them complete; one that is still missing pieces is
+// moved back to its temporary name before anything is written to it.
+func NewPartFile(path string, layout Layout) *FileStorage {
+	s := NewFile(path, layout)
+	s.suffix = PartSuffix
+	s.finalized = placedFiles(path, layout)
+	return s
+}
+
+// placedFiles tells which files of a torrent at path are found under their
+// final name only, moved there by an earlier download or left by anything
+// else. They are not known to be complete until verified.
+func placedFiles(path string, layout Layout) []bool {
+	placed := make([]bool, len(layout.files()))
+	for i := range placed {
+		final := filePath(path, layout, i)
+		if exists(final) && !exists(final+PartSuffix) {
+			placed[i] = true
+		}
+	}
+	return placed
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// moveAside renames a file found under its final name to its temporary
+// name and cuts it to length, so that it can be written without anything
+// watching the final name seeing it change
+func moveAside(final string, length int) error {
+	err := os.Rename(final, final+PartSuffix)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(final+PartSuffix, int64(length))
+}
+
+// OpenFile opens existing data at path for reading only, typically to seed it
+func OpenFile(path string, layout Layout) *FileStorage {
+	s := NewFile(path, layout)
+	s.readOnly = true
+	return s
+}
+
+// FilePath returns where a file of the torrent is currently stored
+func (s *FileStorage) FilePath(index int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentPath(index)
+}
+
+// currentPath is FilePath for callers holding s.mu
+func (s *FileStorage) currentPath(index int) string {
+	path := filePath(s.path, s.layout, index)
+	if s.finalized[index] {
+		return path
+	}
+	return path + s.suffix
+}
+
+func filePath(path string, layout Layout, index int) string {
+	if len(layout.Files) == 0 {
+		return path
+	}
+	return filepath.Join(path, filepath.FromSlash(layout.Files[index].Path))
+}
+
+// open returns the file at index, creating it if create is set. Reading
+// never creates files, so nothing shows up on disk for skipped files.
+func (s *FileStorage) open(index int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if create && s.finalized[index] && s.suffix != "" && !s.fileComplete(s.layout, index) {
+		// Under its final name but missing pieces, it may not even be
+		// data of this torrent: only write to it under its temporary name
+		if s.files[index] != nil {
+			s.files[index].Close()
+			s.files[index] = nil
+		}
+		err := moveAside(filePath(s.path, s.layout, index), s.layout.files()[index].Length)
+		if err != nil {
+			return nil, err
+		}
+		s.finalized[index] = false
+	}
+	if s.files[index] != nil {
+		return s.files[index], nil
+	}
+	path := s.currentPath(index)
+	var f *os.File
+	var err error
+	if s.readOnly {
+		f, err = os.Open(path)
+	} else if !create {
+		f, err = os.OpenFile(path, os.O_RDWR, 0644)
+	} else {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.files[index] = f
+	return f, nil
+}
+
+// ReadAt reads len(p) bytes starting at offset off of a piece
+func (s *FileStorage) ReadAt(p []byte, piece int, off int) (int, error) {
+	segs, err := s.layout.segments(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range segs {
+		f, err := s.open(seg.file, false)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.ReadAt(p[seg.begin:seg.end], seg.offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteAt writes p starting at offset off of a piece
+func (s *FileStorage) WriteAt(p []byte, piece int, off int) (int, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	segs, err := s.layout.segments(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range segs {
+		f, err := s.open(seg.file, true)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.WriteAt(p[seg.begin:seg.end], seg.offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close closes every open file
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for i, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.files[i] = nil
+	}
+	return firstErr
+}
+
+// Finalize flushes every written file to disk and closes it, then renames
+// the files whose pieces are all complete to their final path. Files still
+// missing pieces, like the ones that were skipped, keep their temporary
+// name. Reading afterwards reopens the files where they now are.
+func (s *FileStorage) Finalize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for i, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Sync()
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.files[i] = nil
+	}
+	if firstErr != nil || s.readOnly {
+		return firstErr
+	}
+
+	for i := range s.layout.files() {
+		if s.finalized[i] || !s.fileComplete(s.layout, i) {
+			continue
+		}
+		final := filePath(s.path, s.layout, i)
+		if s.suffix != "" {
+			err := rename(final+s.suffix, final)
+			if err != nil {
+				return err
+			}
+		}
+		s.finalized[i] = true
+	}
+	return nil
+}
+
+// rename moves a finished file into place and syncs its directory so the
+// rename itself survives a crash
+func rename(from, to string) error {
+	_, err := os.Stat(from)
+	if os.IsNotExist(err) {
+		// Empty files are never written to, create them now
+		err = os.MkdirAll(filepath.Dir(from), 0755)
+		if err != nil {
+			return err
+		}
+		var f *os.File
+		f, err = os.Create(from)
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// Some systems cannot sync directories; the rename is done regardless
+	dir.Sync()
+	return nil
+}
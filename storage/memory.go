@@ -0,0 +1,54 @@
+package storage
+
+// Memory keeps the whole torrent in memory. It is mostly useful in tests
+// and for small torrents that are consumed without touching the disk.
+type Memory struct {
+	completion
+	layout Layout
+	data   []byte
+}
+
+// NewMemory allocates storage for a torrent in memory
+func NewMemory(layout Layout) *Memory {
+	return &Memory{
+		completion: newCompletion(layout.NumPieces()),
+		layout:     layout,
+		data:       make([]byte, layout.Length),
+	}
+}
+
+// Bytes returns the data of the whole torrent. It is not a copy.
+func (m *Memory) Bytes() []byte {
+	return m.data
+}
+
+// ReadAt reads len(p) bytes starting at offset off of a piece
+func (m *Memory) ReadAt(p []byte, piece int, off int) (int, error) {
+	begin, err := m.offset(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, m.data[begin:]), nil
+}
+
+// WriteAt writes p starting at offset off of a piece
+func (m *Memory) WriteAt(p []byte, piece int, off int) (int, error) {
+	begin, err := m.offset(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(m.data[begin:], p), nil
+}
+
+func (m *Memory) offset(piece, off, n int) (int, error) {
+	_, err := m.layout.segments(piece, off, n)
+	if err != nil {
+		return 0, err
+	}
+	return piece*m.layout.PieceLength + off, nil
+}
+
+// Close does nothing; the data stays available through Bytes
+func (m *Memory) Close() error {
+	return nil
+}
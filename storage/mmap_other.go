@@ -0,0 +1,13 @@
+//go:build !unix
+
+package storage
+
+// NewMmap falls back to plain files where mmap is not available
+func NewMmap(path string, layout Layout) (Storage, error) {
+	return NewPartFile(path, layout), nil
+}
+
+// OpenMmap falls back to plain files where mmap is not available
+func OpenMmap(path string, layout Layout) (Storage, error) {
+	return OpenFile(path, layout), nil
+}
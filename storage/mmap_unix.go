@@ -0,0 +1,285 @@
+//go:build unix
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"syscall"
+)
+
+// mmapStorage maps every file of a torrent into memory, so reads and writes
+// are plain copies and the page cache is shared with other processes. Like
+// FileStorage it can still be used once closed, mapping the files again.
+type mmapStorage struct {
+	completion
+	layout   Layout
+	path     string
+	readOnly bool
+
+	mu        sync.RWMutex // held for reading while a mapping is copied from or to
+	maps      [][]byte     // nil once closed
+	finalized []bool       // the files under their final name
+}
+
+// NewMmap maps the files of a torrent at path into memory for reading and
+// writing. As with NewPartFile, files are created at their full size under
+// a name ending in PartSuffix, and Finalize moves them into place. Since
+// nothing is verified yet, files found under their final name are moved
+// back to their temporary name to be mapped.
+func NewMmap(path string, layout Layout) (Storage, error) {
+	return newMmap(path, layout, false)
+}
+
+// OpenMmap maps existing data at path into memory for reading only
+func OpenMmap(path string, layout Layout) (Storage, error) {
+	return newMmap(path, layout, true)
+}
+
+func newMmap(path string, layout Layout, readOnly bool) (Storage, error) {
+	s := &mmapStorage{
+		completion: newCompletion(layout.NumPieces()),
+		layout:     layout,
+		path:       path,
+		readOnly:   readOnly,
+		finalized:  make([]bool, len(layout.files())),
+	}
+	if readOnly {
+		for i := range s.finalized {
+			s.finalized[i] = true
+		}
+	} else {
+		s.finalized = placedFiles(path, layout)
+	}
+	err := s.mapFiles()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// mapFiles maps every file. The caller holds s.mu for writing.
+func (s *mmapStorage) mapFiles() error {
+	maps := make([][]byte, len(s.layout.files()))
+	for i, f := range s.layout.files() {
+		if !s.readOnly && s.finalized[i] && !s.fileComplete(s.layout, i) {
+			// Mapped for writing, a file under its final name that is not
+			// known to be complete goes back to its temporary name, see
+			// NewPartFile
+			err := moveAside(filePath(s.path, s.layout, i), f.Length)
+			if err != nil {
+				unmapFiles(maps)
+				return err
+			}
+			s.finalized[i] = false
+		}
+		m, err := mapFile(s.filePath(i), f.Length, s.readOnly)
+		if err != nil {
+			unmapFiles(maps)
+			return err
+		}
+		maps[i] = m
+	}
+	s.maps = maps
+	return nil
+}
+
+// filePath returns where a file is currently stored. The caller holds s.mu.
+func (s *mmapStorage) filePath(index int) string {
+	path := filePath(s.path, s.layout, index)
+	if s.finalized[index] {
+		return path
+	}
+	return path + PartSuffix
+}
+
+// rlock locks s for reading with its files mapped, mapping them again if
+// the storage was closed
+func (s *mmapStorage) rlock() error {
+	for {
+		s.mu.RLock()
+		if s.maps != nil {
+			return nil
+		}
+		s.mu.RUnlock()
+		s.mu.Lock()
+		var err error
+		if s.maps == nil {
+			err = s.mapFiles()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func mapFile(path string, length int, readOnly bool) ([]byte, error) {
+	flag, prot := os.O_RDONLY, syscall.PROT_READ
+	if !readOnly {
+		flag, prot = os.O_RDWR|os.O_CREATE, syscall.PROT_READ|syscall.PROT_WRITE
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid once the file is closed
+	defer f.Close()
+	if length == 0 {
+		return nil, nil
+	}
+	if readOnly {
+		// Touching a mapping past the end of the file raises SIGBUS, see
+		// copyMapped
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < int64(length) {
+			return nil, fmt.Errorf("%s is %d bytes, want %d", path, info.Size(), length)
+		}
+	} else {
+		err = f.Truncate(int64(length))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return syscall.Mmap(int(f.Fd()), 0, length, prot, syscall.MAP_SHARED)
+}
+
+func (s *mmapStorage) ReadAt(p []byte, piece int, off int) (int, error) {
+	segs, err := s.layout.segments(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	err = s.rlock()
+	if err != nil {
+		return 0, err
+	}
+	defer s.mu.RUnlock()
+	n := 0
+	for _, seg := range segs {
+		m, err := copyMapped(p[seg.begin:seg.end], s.maps[seg.file][seg.offset:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *mmapStorage) WriteAt(p []byte, piece int, off int) (int, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	segs, err := s.layout.segments(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	err = s.rlock()
+	if err != nil {
+		return 0, err
+	}
+	defer s.mu.RUnlock()
+	n := 0
+	for _, seg := range segs {
+		m, err := copyMapped(s.maps[seg.file][seg.offset:], p[seg.begin:seg.end])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// copyMapped copies between memory and a mapping. Touching a mapping past
+// the end of its file raises SIGBUS, as when another process truncates a
+// file being seeded; that fault is returned as an error instead of
+// crashing the program.
+func copyMapped(dst, src []byte) (n int, err error) {
+	old := debug.SetPanicOnFault(true)
+	defer func() {
+		debug.SetPanicOnFault(old)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("mapped file changed underneath: %v", r)
+		}
+	}()
+	return copy(dst, src), nil
+}
+
+// Close unmaps every file. Dirty pages are written back by the kernel.
+func (s *mmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := unmapFiles(s.maps)
+	s.maps = nil
+	return err
+}
+
+// Finalize unmaps every file and flushes it to disk, then renames the files
+// whose pieces are all complete to their final path, like
+// FileStorage.Finalize. Using the storage afterwards maps the files again
+// where they now are.
+func (s *mmapStorage) Finalize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := unmapFiles(s.maps)
+	s.maps = nil
+	if err != nil || s.readOnly {
+		return err
+	}
+	for i := range s.layout.files() {
+		// Unmapping leaves the written pages in the page cache, from
+		// which Sync writes them out
+		err = syncFile(s.filePath(i))
+		if err != nil {
+			return err
+		}
+	}
+	for i := range s.layout.files() {
+		if s.finalized[i] || !s.fileComplete(s.layout, i) {
+			continue
+		}
+		final := filePath(s.path, s.layout, i)
+		err = rename(final+PartSuffix, final)
+		if err != nil {
+			return err
+		}
+		s.finalized[i] = true
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func unmapFiles(maps [][]byte) error {
+	var firstErr error
+	for _, m := range maps {
+		if m == nil {
+			continue
+		}
+		err := syscall.Munmap(m)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
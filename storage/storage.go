@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"sync"
+)
+
+// Storage holds the data of a torrent. Data is addressed by piece index and
+// offset within the piece, whatever the files it is stored in.
+type Storage interface {
+	// ReadAt reads len(p) bytes starting at offset off of a piece
+	ReadAt(p []byte, piece int, off int) (int, error)
+	// WriteAt writes p starting at offset off of a piece
+	WriteAt(p []byte, piece int, off int) (int, error)
+	// MarkComplete records that a piece has been written and verified
+	MarkComplete(piece int) error
+	// Completed tells if a piece has been marked complete
+	Completed(piece int) bool
+	// Close releases the resources held by the storage
+	Close() error
+}
+
+// Finalizer is storage keeping data under temporary names until Finalize
+// flushes it to disk and moves it into place, like NewPartFile
+type Finalizer interface {
+	Finalize() error
+}
+
+// File is one of the files of a multi-file torrent. Files are laid out one
+// after the other, in order, in the torrent's data.
+type File struct {
+	Path   string // slash separated, relative to the torrent's directory
+	Length int
+}
+
+// Layout describes how the pieces of a torrent map onto its files
+type Layout struct {
+	PieceLength int
+	Length      int
+	Files       []File // empty for a single-file torrent
+}
+
+// NumPieces returns the number of pieces of the torrent
+func (l Layout) NumPieces() int {
+	if l.PieceLength <= 0 {
+		return 0
+	}
+	return (l.Length + l.PieceLength - 1) / l.PieceLength
+}
+
+// PieceSize returns the length of a piece; the last one may be shorter
+func (l Layout) PieceSize(piece int) int {
+	begin := piece * l.PieceLength
+	end := begin + l.PieceLength
+	if end > l.Length {
+		end = l.Length
+	}
+	if end < begin {
+		return 0
+	}
+	return end - begin
+}
+
+func (l Layout) files() []File {
+	if len(l.Files) == 0 {
+		return []File{{Length: l.Length}}
+	}
+	return l.Files
+}
+
+// filePieces returns the first and last pieces overlapping a file. last is
+// below first for an empty file, which needs no piece.
+func (l Layout) filePieces(index int) (first, last int) {
+	var begin int
+	files := l.files()
+	for _, f := range files[:index] {
+		begin += f.Length
+	}
+	end := begin + files[index].Length
+	if l.PieceLength <= 0 || end == begin {
+		return 0, -1
+	}
+	return begin / l.PieceLength, (end - 1) / l.PieceLength
+}
+
+// segment is the part of a read or write that falls into a single file
+type segment struct {
+	file   int
+	offset int64 // offset in the file
+	begin  int   // offset in the caller's buffer
+	end    int
+}
+
+// segments splits n bytes at offset off of a piece into per-file segments
+func (l Layout) segments(piece, off, n int) ([]segment, error) {
+	if piece < 0 || off < 0 || off+n > l.PieceSize(piece) {
+		return nil, fmt.Errorf("range %d+%d out of bounds for piece %d", off, n, piece)
+	}
+	pos := int64(piece)*int64(l.PieceLength) + int64(off)
+	end := pos + int64(n)
+	var segs []segment
+	var fileBegin int64
+	for i, f := range l.files() {
+		fileEnd := fileBegin + int64(f.Length)
+		if pos < fileEnd && end > fileBegin {
+			from, to := pos, end
+			if from < fileBegin {
+				from = fileBegin
+			}
+			if to > fileEnd {
+				to = fileEnd
+			}
+			segs = append(segs, segment{
+				file:   i,
+				offset: from - fileBegin,
+				begin:  int(from - pos),
+				end:    int(to - pos),
+			})
+		}
+		fileBegin = fileEnd
+	}
+	return segs, nil
+}
+
+// ErrReadOnly is returned when writing to storage opened read-only
+var ErrReadOnly = errors.New("storage is read-only")
+
+// completion tracks the pieces marked complete; every backend embeds it
+type completion struct {
+	mu   sync.Mutex
+	done bitfield.Bitfield
+}
+
+func newCompletion(numPieces int) completion {
+	return completion{done: make(bitfield.Bitfield, (numPieces+7)/8)}
+}
+
+// MarkComplete records that a piece has been written and verified
+func (c *completion) MarkComplete(piece int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done.SetPiece(piece)
+	return nil
+}
+
+// Completed tells if a piece has been marked complete
+func (c *completion) Completed(piece int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done.HasPiece(piece)
+}
+
+// fileComplete tells if every piece overlapping a file is complete
+func (c *completion) fileComplete(layout Layout, index int) bool {
+	first, last := layout.filePieces(index)
+	for piece := first; piece <= last; piece++ {
+		if !c.Completed(piece) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,28 @@
+package storage
+
+import "crypto/sha1"
+
+// Verify hashes the pieces of st that are not marked complete and marks
+// those matching their hash, so a download picks up the data already on
+// disk. It returns the number of complete pieces.
+func Verify(st Storage, layout Layout, hashes [][20]byte) (int, error) {
+	buf := make([]byte, layout.PieceLength)
+	complete := 0
+	for i, hash := range hashes {
+		if st.Completed(i) {
+			complete++
+			continue
+		}
+		piece := buf[:layout.PieceSize(i)]
+		_, err := st.ReadAt(piece, i, 0)
+		if err != nil || sha1.Sum(piece) != hash {
+			continue
+		}
+		err = st.MarkComplete(i)
+		if err != nil {
+			return complete, err
+		}
+		complete++
+	}
+	return complete, nil
+}
@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves the content of torrents over HTTP while they download. Each
+// file of a torrent is available at a stable URL (see Path) and supports Range
+// requests, so media players can seek; the pieces under a requested range
+// are downloaded before any other.
+type Server struct {
+	mu       sync.RWMutex
+	torrents map[[20]byte]*entry
+}
+
+type entry struct {
+	t     *protocol.Torrent
+	added time.Time
+}
+
+// NewServer creates a server with no torrents
+func NewServer() *Server {
+	return &Server{torrents: make(map[[20]byte]*entry)}
+}
+
+// Add makes a torrent available. It replaces a torrent with the same infohash.
+func (s *Server) Add(t *protocol.Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[t.InfoHash] = &entry{t: t, added: time.Now()}
+}
+
+// Remove stops serving a torrent
+func (s *Server) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// Path returns the URL path under which a file of a torrent is served
+func Path(t *protocol.Torrent, file int) string {
+	var elems []string
+	for _, elem := range strings.Split(filePath(t, file), "/") {
+		elems = append(elems, url.PathEscape(elem))
+	}
+	return "/torrents/" + hex.EncodeToString(t.InfoHash[:]) + "/" + strings.Join(elems, "/")
+}
+
+// filePath names a file the way it appears in its URL: the torrent's name,
+// followed by the file's path for a multi-file torrent
+func filePath(t *protocol.Torrent, file int) string {
+	if len(t.Files) == 0 {
+		return t.Name
+	}
+	return t.Name + "/" + t.Files[file].Path
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/" {
+		s.serveIndex(w)
+		return
+	}
+
+	// /torrents/<infohash>/<name>[/<file path>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/torrents/"), "/", 2)
+	if len(parts) != 2 || !strings.HasPrefix(r.URL.Path, "/torrents/") {
+		http.NotFound(w, r)
+		return
+	}
+	var infoHash [20]byte
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || len(raw) != len(infoHash) {
+		http.NotFound(w, r)
+		return
+	}
+	copy(infoHash[:], raw)
+
+	s.mu.RLock()
+	e, ok := s.torrents[infoHash]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	file := -1
+	for i := range e.t.FileList() {
+		if filePath(e.t, i) == parts[1] {
+			file = i
+			break
+		}
+	}
+	if file < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	rd, err := e.t.NewFileReader(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rd.Close()
+
+	// A player that goes away must not leave the read blocked on a piece
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			rd.Close()
+		case <-done:
+		}
+	}()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, parts[1], e.added, rd)
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter) {
+	s.mu.RLock()
+	torrents := make([]*protocol.Torrent, 0, len(s.torrents))
+	for _, e := range s.torrents {
+		torrents = append(torrents, e.t)
+	}
+	s.mu.RUnlock()
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].Name < torrents[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html><title>P2Pin3</title><ul>")
+	for _, t := range torrents {
+		p := t.Stats()
+		fmt.Fprintf(w, "<li>%s (%0.2f%%)<ul>\n", html.EscapeString(t.Name), p.Percent())
+		for i := range t.FileList() {
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", Path(t, i), html.EscapeString(filePath(t, i)))
+		}
+		fmt.Fprintln(w, "</ul></li>")
+	}
+	fmt.Fprintln(w, "</ul>")
+}
@@ -0,0 +1,339 @@
+package swarmtest
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultRetransmit is how late a dropped packet arrives when Link does not
+// say
+const DefaultRetransmit = 200 * time.Millisecond
+
+// linkQueue is how many writes a direction of a link holds before writers
+// have to wait, like the buffer of a socket
+const linkQueue = 64
+
+// Link shapes the traffic of a connection, each direction on its own. The
+// zero Link passes everything through at once.
+type Link struct {
+	// Latency delays every byte
+	Latency time.Duration
+
+	// Bandwidth caps each direction in bytes per second; zero is unlimited
+	Bandwidth int64
+
+	// Drop is the probability that a packet is lost. As over TCP, it is
+	// sent again after Retransmit and holds back what follows it.
+	Drop       float64
+	Retransmit time.Duration
+}
+
+// Listen returns l with every connection it accepts going through the
+// link. Packets are dropped at random from seed.
+func (link Link) Listen(l net.Listener, seed int64) net.Listener {
+	return &listener{Listener: l, link: link, seed: seed}
+}
+
+type listener struct {
+	net.Listener
+	link Link
+
+	mu    sync.Mutex
+	seed  int64
+	conns int64
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.conns++
+	seed := l.seed + l.conns
+	l.mu.Unlock()
+	return l.link.Conn(c, seed), nil
+}
+
+// Conn returns c going through the link: what is written to it and what is
+// read from it are both delayed. Packets are dropped at random from seed.
+// Deadlines apply to the shaped connection; c must not be used any more.
+func (link Link) Conn(c net.Conn, seed int64) net.Conn {
+	rng := rand.New(rand.NewSource(seed))
+	sc := &conn{
+		Conn:    c,
+		send:    schedule{link: link, rng: rand.New(rand.NewSource(rng.Int63()))},
+		recv:    schedule{link: link, rng: rand.New(rand.NewSource(rng.Int63()))},
+		outbox:  make(chan chunk, linkQueue),
+		arrived: make(chan chunk, linkQueue),
+		inbox:   make(chan chunk),
+		closed:  make(chan struct{}),
+	}
+	sc.readDeadline.changed = make(chan struct{})
+	sc.writeDeadline.changed = make(chan struct{})
+	go sc.sendLoop()
+	go sc.recvLoop()
+	go sc.deliverLoop()
+	return sc
+}
+
+// chunk is the data of one read or write, or the error that ended the
+// stream
+type chunk struct {
+	data []byte
+	err  error
+	at   time.Time // when it reaches the other end
+}
+
+// schedule works out when packets sent one after the other arrive
+type schedule struct {
+	link Link
+	rng  *rand.Rand
+	free time.Time // when the link is done sending what it was given
+	last time.Time // when the previous packet arrives
+}
+
+func (s *schedule) arrival(n int, now time.Time) time.Time {
+	start := now
+	if s.free.After(start) {
+		start = s.free
+	}
+	s.free = start
+	if s.link.Bandwidth > 0 {
+		s.free = start.Add(time.Duration(float64(n) / float64(s.link.Bandwidth) * float64(time.Second)))
+	}
+	at := s.free.Add(s.link.Latency)
+	if s.link.Drop > 0 && s.rng.Float64() < s.link.Drop {
+		retransmit := s.link.Retransmit
+		if retransmit <= 0 {
+			retransmit = DefaultRetransmit
+		}
+		at = at.Add(retransmit)
+	}
+	// Nothing overtakes a packet that was dropped
+	if at.Before(s.last) {
+		at = s.last
+	}
+	s.last = at
+	return at
+}
+
+type conn struct {
+	net.Conn
+
+	sendMu sync.Mutex // orders the writes and guards send
+	send   schedule
+	outbox chan chunk
+
+	recv    schedule // only used by recvLoop
+	arrived chan chunk
+	inbox   chan chunk
+	pending chunk // the rest of a chunk Read did not take whole
+
+	readDeadline, writeDeadline deadline
+
+	mu       sync.Mutex
+	writeErr error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	err := c.writeErr
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	data := append([]byte(nil), p...)
+	at := c.send.arrival(len(data), time.Now())
+	for {
+		timeout, changed, stop := c.writeDeadline.wait()
+		select {
+		case <-c.closed:
+			stop()
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			stop()
+			continue
+		case c.outbox <- chunk{data: data, at: at}:
+			stop()
+			return len(p), nil
+		}
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.pending.data) == 0 && c.pending.err == nil {
+		for {
+			timeout, changed, stop := c.readDeadline.wait()
+			select {
+			case <-c.closed:
+				stop()
+				return 0, net.ErrClosed
+			case <-timeout:
+				return 0, os.ErrDeadlineExceeded
+			case <-changed:
+				stop()
+				continue
+			case c.pending = <-c.inbox:
+				stop()
+			}
+			break
+		}
+	}
+	if len(c.pending.data) == 0 {
+		return 0, c.pending.err
+	}
+	n := copy(p, c.pending.data)
+	c.pending.data = c.pending.data[n:]
+	return n, nil
+}
+
+// Close drops what was not read yet, but still sends what was written
+// before closing the connection underneath, as TCP does
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// sendLoop writes each chunk to the connection underneath once it is due,
+// then closes it
+func (c *conn) sendLoop() {
+	defer c.Conn.Close()
+	for {
+		select {
+		case ch := <-c.outbox:
+			if !c.sendAt(ch) {
+				return
+			}
+		case <-c.closed:
+			// What was written before closing still gets through, in time
+			for {
+				select {
+				case ch := <-c.outbox:
+					if !c.sendAt(ch) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *conn) sendAt(ch chunk) bool {
+	time.Sleep(time.Until(ch.at))
+	_, err := c.Conn.Write(ch.data)
+	if err != nil {
+		c.mu.Lock()
+		c.writeErr = err
+		c.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// recvLoop reads from the connection underneath, working out when each
+// read would have arrived over the link
+func (c *conn) recvLoop() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := c.Conn.Read(buf)
+		now := time.Now()
+		if n > 0 {
+			ch := chunk{data: buf[:n], at: c.recv.arrival(n, now)}
+			select {
+			case c.arrived <- ch:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case c.arrived <- chunk{err: err, at: c.recv.last}:
+			case <-c.closed:
+			}
+			return
+		}
+	}
+}
+
+// deliverLoop hands what was read to Read once it is due
+func (c *conn) deliverLoop() {
+	for {
+		var ch chunk
+		select {
+		case ch = <-c.arrived:
+		case <-c.closed:
+			return
+		}
+		timer := time.NewTimer(time.Until(ch.at))
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return
+		}
+		select {
+		case c.inbox <- ch:
+		case <-c.closed:
+			return
+		}
+		if ch.err != nil {
+			return
+		}
+	}
+}
+
+// deadline is a deadline that can be moved while something waits for it
+type deadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// wait returns a channel receiving once the deadline passes, nil if there
+// is none, and one closed when the deadline is moved
+func (d *deadline) wait() (timeout <-chan time.Time, changed <-chan struct{}, stop func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.t.IsZero() {
+		return nil, d.changed, func() {}
+	}
+	timer := time.NewTimer(time.Until(d.t))
+	return timer.C, d.changed, func() { timer.Stop() }
+}
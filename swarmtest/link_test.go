@@ -0,0 +1,133 @@
+package swarmtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// linkPair returns both ends of a loopback connection, the server one going
+// through link
+func linkPair(t *testing.T, link Link) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := link.Listen(l, 1).Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestLinkLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	client, server := linkPair(t, Link{Latency: latency})
+	go io.Copy(server, server) // echo
+
+	start := time.Now()
+	_, err := client.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt := time.Since(start); rtt < 2*latency {
+		t.Errorf("round trip took %v, want at least %v", rtt, 2*latency)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echoed %q", buf)
+	}
+}
+
+func TestLinkBandwidth(t *testing.T) {
+	const bandwidth = 1 << 20
+	client, server := linkPair(t, Link{Bandwidth: bandwidth})
+	data := bytes.Repeat([]byte("0123456789abcdef"), bandwidth/4/16)
+
+	start := time.Now()
+	go func() {
+		server.Write(data)
+		server.Close()
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("sent %d bytes in %v at %d bytes/s", len(data), took, bandwidth)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, not what was sent", len(got))
+	}
+}
+
+func TestLinkDropKeepsOrder(t *testing.T) {
+	client, server := linkPair(t, Link{Drop: 0.3, Retransmit: 5 * time.Millisecond})
+	go func() {
+		for i := 0; i < 100; i++ {
+			server.Write([]byte{byte(i)})
+		}
+		server.Close()
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("received %d bytes, want 100", len(got))
+	}
+	for i, b := range got {
+		if int(b) != i {
+			t.Fatalf("byte %d is %d", i, b)
+		}
+	}
+}
+
+func TestLinkReadDeadline(t *testing.T) {
+	_, server := linkPair(t, Link{Latency: time.Millisecond})
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := server.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+
+	// Clearing the deadline lets reads wait again
+	server.SetReadDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("read returned %v without data", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("err = %v after closing, want net.ErrClosed", err)
+	}
+}
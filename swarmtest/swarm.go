@@ -0,0 +1,273 @@
+// Package swarmtest runs a whole swarm in one process for integration
+// tests: a tracker, seeders and leechers talking over loopback, with the
+// links to the seeders adding latency, limiting bandwidth and dropping
+// packets.
+package swarmtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/ratelimit"
+	"github.com/lvkeliang/P2Pin3/seeder"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"github.com/lvkeliang/P2Pin3/tracker"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults of a Config
+const (
+	DefaultSize        = 1 << 20
+	DefaultPieceLength = 16 * 1024
+)
+
+// Config describes a swarm
+type Config struct {
+	Seeders  int
+	Leechers int
+
+	// Size is the length of the file shared, DefaultSize when zero.
+	// PieceLength defaults to DefaultPieceLength.
+	Size        int
+	PieceLength int
+
+	// Link is what every connection to a seeder goes through
+	Link Link
+
+	// UploadLimit caps the upload rate of each seeder in bytes per second;
+	// zero is unlimited
+	UploadLimit int64
+
+	// Seed draws the data shared and the packets dropped, so that a run can
+	// be repeated
+	Seed int64
+
+	// Dir is where the files of the swarm are written. A temporary
+	// directory, removed by Close, is used when it is empty.
+	Dir string
+}
+
+// Swarm is a tracker, seeders having the whole file and leechers that
+// download it when Run is called
+type Swarm struct {
+	Config
+
+	Torrent  *torrent.TorrentFile
+	Data     []byte // the file shared
+	Tracker  *tracker.Tracker
+	Seeders  []*Seeder
+	Leechers []*Leecher
+
+	trackerServer *http.Server
+	removeDir     bool
+}
+
+// Seeder is a peer uploading the whole file
+type Seeder struct {
+	Addr     string
+	PeerID   [20]byte
+	Registry *seeder.Registry
+	Seed     *seeder.Seed
+
+	listener net.Listener
+}
+
+// Uploaded returns the bytes of the file the seeder sent
+func (s *Seeder) Uploaded() int64 {
+	return s.Seed.Uploaded.Load()
+}
+
+// Leecher is a peer downloading the file
+type Leecher struct {
+	PeerID [20]byte
+	Path   string // where the file is written
+
+	// Download is the download of the last Run, Took how long it ran and
+	// Err how it ended
+	Download *protocol.Torrent
+	Took     time.Duration
+	Err      error
+
+	libraryPath string
+}
+
+// Start creates the file and its torrent, and starts the tracker and the
+// seeders, each of which has announced itself once Start returns.
+func Start(ctx context.Context, cfg Config) (*Swarm, error) {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultSize
+	}
+	if cfg.PieceLength <= 0 {
+		cfg.PieceLength = DefaultPieceLength
+	}
+	s := &Swarm{Config: cfg}
+	err := s.start(ctx)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Swarm) start(ctx context.Context) error {
+	cfg := s.Config
+	var err error
+	if s.Dir == "" {
+		s.Dir, err = os.MkdirTemp("", "swarmtest")
+		if err != nil {
+			return err
+		}
+		s.removeDir = true
+	}
+
+	s.Tracker = tracker.New(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/announce", s.Tracker)
+	s.trackerServer = &http.Server{Handler: mux}
+	go s.trackerServer.Serve(l)
+
+	s.Data = make([]byte, cfg.Size)
+	mathrand.New(mathrand.NewSource(cfg.Seed)).Read(s.Data)
+	dataPath := filepath.Join(s.Dir, "seed", "swarm.bin")
+	err = os.MkdirAll(filepath.Dir(dataPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(dataPath, s.Data, 0644)
+	if err != nil {
+		return err
+	}
+	s.Torrent, err = torrent.NewTorrentFile(dataPath, "http://"+l.Addr().String()+"/announce", cfg.PieceLength)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < cfg.Seeders; i++ {
+		sd, err := s.startSeeder(ctx, dataPath, cfg.Seed+int64(i+1)<<32)
+		if err != nil {
+			return fmt.Errorf("seeder %d: %w", i, err)
+		}
+		s.Seeders = append(s.Seeders, sd)
+	}
+	for i := 0; i < cfg.Leechers; i++ {
+		dir := filepath.Join(s.Dir, fmt.Sprintf("leecher%d", i))
+		le := &Leecher{
+			Path:        filepath.Join(dir, s.Torrent.Name),
+			libraryPath: filepath.Join(dir, "library.json"),
+		}
+		_, err = rand.Read(le.PeerID[:])
+		if err != nil {
+			return err
+		}
+		s.Leechers = append(s.Leechers, le)
+	}
+	return nil
+}
+
+func (s *Swarm) startSeeder(ctx context.Context, dataPath string, seed int64) (*Seeder, error) {
+	sd := &Seeder{Registry: seeder.NewRegistry()}
+	_, err := rand.Read(sd.PeerID[:])
+	if err != nil {
+		return nil, err
+	}
+	sd.Registry.Add(s.Torrent, dataPath)
+	sd.Seed, _ = sd.Registry.Lookup(s.Torrent.InfoHash)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	sd.listener = l
+	sd.Addr = l.Addr().String()
+	server := &seeder.Server{
+		Registry:    sd.Registry,
+		PeerID:      sd.PeerID,
+		UploadLimit: ratelimit.New(s.UploadLimit),
+	}
+	go server.Serve(s.Link.Listen(l, seed))
+	_, err = s.Torrent.AnnounceSeed(ctx, sd.PeerID, uint16(l.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		l.Close()
+		sd.Registry.Remove(s.Torrent.InfoHash)
+		return nil, err
+	}
+	return sd, nil
+}
+
+// Run has every leecher download the file at once, and returns once all of
+// them are done. The error tells which leechers failed.
+func (s *Swarm) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, le := range s.Leechers {
+		wg.Add(1)
+		go func(le *Leecher) {
+			defer wg.Done()
+			le.Err = s.download(ctx, le)
+		}(le)
+	}
+	wg.Wait()
+	var errs []error
+	for i, le := range s.Leechers {
+		if le.Err != nil {
+			errs = append(errs, fmt.Errorf("leecher %d: %w", i, le.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Swarm) download(ctx context.Context, le *Leecher) error {
+	start := time.Now()
+	defer func() { le.Took = time.Since(start) }()
+	err := os.MkdirAll(filepath.Dir(le.Path), 0755)
+	if err != nil {
+		return err
+	}
+	le.Download, err = s.Torrent.NewDownloadAs(ctx, le.PeerID)
+	if err != nil {
+		return err
+	}
+	return s.Torrent.RunDownload(ctx, le.Download, le.Path, le.libraryPath)
+}
+
+// Verify checks that every leecher wrote the file as the seeders have it
+func (s *Swarm) Verify() error {
+	var errs []error
+	for i, le := range s.Leechers {
+		data, err := os.ReadFile(le.Path)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("leecher %d: %w", i, err))
+		case !bytes.Equal(data, s.Data):
+			errs = append(errs, fmt.Errorf("leecher %d: %s differs from the file seeded", i, le.Path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the tracker and the seeders, and removes the temporary
+// directory
+func (s *Swarm) Close() error {
+	for _, sd := range s.Seeders {
+		sd.listener.Close()
+		sd.Registry.Remove(s.Torrent.InfoHash)
+	}
+	if s.trackerServer != nil {
+		s.trackerServer.Close()
+	}
+	if s.removeDir {
+		return os.RemoveAll(s.Dir)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package swarmtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func runSwarm(t *testing.T, cfg Config) *Swarm {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cfg.Dir = t.TempDir()
+	s, err := Start(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	err = s.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSwarmCompletes(t *testing.T) {
+	s := runSwarm(t, Config{
+		Seeders:  2,
+		Leechers: 3,
+		Size:     512 * 1024,
+		Link:     Link{Latency: 5 * time.Millisecond},
+		Seed:     1,
+	})
+	for i, le := range s.Leechers {
+		stats := le.Download.Stats()
+		if stats.PiecesDone != len(s.Torrent.PieceHashes) {
+			t.Errorf("leecher %d has %d of %d pieces", i, stats.PiecesDone, len(s.Torrent.PieceHashes))
+		}
+		if stats.HashFailed != 0 {
+			t.Errorf("leecher %d got %d corrupt pieces", i, stats.HashFailed)
+		}
+	}
+}
+
+func TestSwarmLossyLinks(t *testing.T) {
+	runSwarm(t, Config{
+		Seeders:  2,
+		Leechers: 2,
+		Size:     256 * 1024,
+		Link: Link{
+			Latency:    10 * time.Millisecond,
+			Bandwidth:  2 << 20,
+			Drop:       0.05,
+			Retransmit: 30 * time.Millisecond,
+		},
+		Seed: 2,
+	})
+}
+
+func TestSwarmOddSizes(t *testing.T) {
+	// The last piece is short and the pieces are not a multiple of a block
+	runSwarm(t, Config{
+		Seeders:     1,
+		Leechers:    2,
+		Size:        100*1000 + 7,
+		PieceLength: 20 * 1000,
+		Seed:        3,
+	})
+}
+
+func TestSwarmFairness(t *testing.T) {
+	const seeders, leechers = 3, 3
+	s := runSwarm(t, Config{
+		Seeders:     seeders,
+		Leechers:    leechers,
+		Size:        512 * 1024,
+		UploadLimit: 256 * 1024,
+		Link:        Link{Latency: 2 * time.Millisecond},
+		Seed:        4,
+	})
+
+	// Seeders with the same bandwidth should share the uploading
+	var total int64
+	for _, sd := range s.Seeders {
+		total += sd.Uploaded()
+	}
+	if want := int64(leechers * s.Size); total < want {
+		t.Errorf("seeders uploaded %d bytes, want at least %d", total, want)
+	}
+	for i, sd := range s.Seeders {
+		if share := float64(sd.Uploaded()) / float64(total); share < 1.0/seeders/3 {
+			t.Errorf("seeder %d uploaded %.0f%% of the data", i, share*100)
+		}
+	}
+
+	// Leechers starting together should finish at about the same time
+	fastest, slowest := s.Leechers[0].Took, s.Leechers[0].Took
+	for _, le := range s.Leechers[1:] {
+		fastest = min(fastest, le.Took)
+		slowest = max(slowest, le.Took)
+	}
+	if slowest > 3*fastest+200*time.Millisecond {
+		t.Errorf("leechers took from %v to %v", fastest, slowest)
+	}
+}
@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"context"
+	"github.com/lvkeliang/P2Pin3/logic"
+	"github.com/lvkeliang/P2Pin3/metrics"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"sync"
+	"time"
+)
+
+// TrackerStatus is the outcome of the last announce of a torrent
+type TrackerStatus struct {
+	URL   string    `json:"url"`
+	Time  time.Time `json:"time"`  // zero before the first announce
+	Peers int       `json:"peers"` // returned by the last announce
+	Error string    `json:"error,omitempty"`
+}
+
+// Tracker records the announces of a torrent so they can be shown
+type Tracker struct {
+	mu       sync.Mutex
+	status   TrackerStatus
+	failures int
+
+	latency *metrics.Histogram
+}
+
+// NewTracker creates a tracker status for the torrent, before any announce
+func NewTracker(t *TorrentFile) *Tracker {
+	return &Tracker{status: TrackerStatus{URL: t.Announce}, latency: metrics.NewHistogram()}
+}
+
+// Status returns the outcome of the last announce
+func (tr *Tracker) Status() TrackerStatus {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.status
+}
+
+// Record stores the outcome of an announce and how long it took, zero
+// when unknown
+func (tr *Tracker) Record(peers int, took time.Duration, err error) {
+	if took > 0 {
+		tr.latency.Observe(took.Seconds())
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.status.Time = time.Now()
+	tr.status.Peers = peers
+	tr.status.Error = ""
+	if err != nil {
+		tr.status.Error = err.Error()
+		tr.failures++
+	}
+}
+
+// WriteMetrics writes the announce latency, failures and the swarm size
+// last returned by the tracker, labelled with the infohash
+func (tr *Tracker) WriteMetrics(w *metrics.Writer, infoHash string) {
+	status := tr.Status()
+	tr.mu.Lock()
+	failures := tr.failures
+	tr.mu.Unlock()
+	w.Histogram("p2pin3_announce_duration_seconds", "Time taken by announces to the tracker.",
+		tr.latency, "infohash", infoHash)
+	w.Counter("p2pin3_announce_failures_total", "Announces to the tracker that failed.",
+		float64(failures), "infohash", infoHash)
+	w.Gauge("p2pin3_swarm_peers", "Peers returned by the last announce to the tracker.",
+		float64(status.Peers), "infohash", infoHash)
+}
+
+// Follow records the announce NewDownload made for dl and every later one
+// made through its PeerSource
+func (tr *Tracker) Follow(dl *protocol.Torrent) {
+	tr.Record(len(dl.Peers), 0, nil)
+	source := dl.PeerSource
+	if source == nil {
+		return
+	}
+	dl.PeerSource = func(ctx context.Context) ([]logic.Peer, error) {
+		start := time.Now()
+		peers, err := source(ctx)
+		if ctx.Err() == nil {
+			tr.Record(len(peers), time.Since(start), err)
+		}
+		return peers, err
+	}
+}
@@ -1,18 +1,32 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/base32"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"github.com/lvkeliang/P2Pin3/library"
 	"github.com/lvkeliang/P2Pin3/logic"
 	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/storage"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Port 监听地址
@@ -26,14 +40,22 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []protocol.File `json:",omitempty"` //多文件种子中的文件列表，单文件种子为空
 }
 
 // 解析的 info 部分
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files"` //多文件种子中的文件列表
+}
+
+// 多文件种子中的一个文件，Path 为各级目录和文件名
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 // 解析整个文件
@@ -42,18 +64,36 @@ type bencodeTorrent struct {
 	Info     bencodeInfo `bencode:"info"`     //用于存储解析出的 info 部分信息。
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
-func (t *TorrentFile) DownloadToFile(path string, hashmapPath string) error {
+// DownloadToFile downloads a torrent and writes it to a file. The download
+// is abandoned when ctx is cancelled.
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, hashmapPath string) error {
+	dl, err := t.NewDownload(ctx)
+	if err != nil {
+		return err
+	}
+	return t.RunDownload(ctx, dl, path, hashmapPath)
+}
+
+// NewDownload asks the tracker for peers and prepares a download of the
+// torrent under a random peer ID. Set OnEvent on the result to follow its
+// progress.
+func (t *TorrentFile) NewDownload(ctx context.Context) (*protocol.Torrent, error) {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	if err != nil {
-		return err
+		return nil, err
 	}
-	peers, err := t.requestPeers(peerID, Port)
+	return t.NewDownloadAs(ctx, peerID)
+}
+
+// NewDownloadAs is NewDownload for a client with its own peer ID
+func (t *TorrentFile) NewDownloadAs(ctx context.Context, peerID [20]byte) (*protocol.Torrent, error) {
+	// 下载方不接受连接，端口为 0 时 tracker 只返回 peer 而不记录下载方
+	peers, err := t.requestPeers(ctx, peerID, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	torrent := protocol.Torrent{
+	return &protocol.Torrent{
 		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
@@ -61,23 +101,62 @@ func (t *TorrentFile) DownloadToFile(path string, hashmapPath string) error {
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Files:       t.Files,
+		PeerSource: func(ctx context.Context) ([]logic.Peer, error) {
+			return t.requestPeers(ctx, peerID, 0)
+		},
+	}, nil
+}
+
+// RunDownload runs a download prepared by NewDownload and writes it to a
+// file. A multi-file torrent is written to a directory at path.
+// Data is kept in ".part" files until every wanted piece is verified, then
+// flushed to disk and renamed to its final path; files that were skipped
+// keep their ".part" name.
+func (t *TorrentFile) RunDownload(ctx context.Context, dl *protocol.Torrent, path string, hashmapPath string) error {
+	if dl.Storage == nil {
+		dl.Storage = storage.NewPartFile(path, dl.Layout())
 	}
-	buf, err := torrent.Download()
+	err := dl.Download(ctx)
 	if err != nil {
+		dl.Storage.Close()
 		return err
 	}
-	outFile, err := os.Create(path)
-	if err != nil {
-		return err
+	if files, ok := dl.Storage.(storage.Finalizer); ok {
+		err = files.Finalize()
+	} else {
+		err = dl.Storage.Close()
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
 	if err != nil {
 		return err
 	}
 
-	UpdateInfoHash(t.InfoHash, path, hashmapPath)
-	return nil
+	return t.Record(hashmapPath, path, func(e *library.Entry) {
+		e.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+		complete := true
+		for i := range t.PieceHashes {
+			if dl.Storage.Completed(i) {
+				e.Bitfield.SetPiece(i)
+			} else {
+				complete = false
+			}
+		}
+		e.Downloaded += dl.Stats().Downloaded
+		// Skipping files leaves the torrent incomplete, to be resumed once
+		// they are wanted
+		if complete {
+			e.Completed = time.Now()
+		}
+	})
+}
+
+// Layout describes how the torrent's pieces map onto its files
+func (t *TorrentFile) Layout() storage.Layout {
+	return storage.Layout{
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Files:       t.Files,
+	}
 }
 
 type bencodeTrackerResp struct {
@@ -94,10 +173,28 @@ type TrackerResponse struct {
 	Peers []logic.Peer `json:"peers"`
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]logic.Peer, error) {
-	url := t.Announce
+// AnnounceSeed tells the tracker that the peer listening on port has the
+// torrent, and returns the other peers it knows
+func (t *TorrentFile) AnnounceSeed(ctx context.Context, peerID [20]byte, port uint16) ([]logic.Peer, error) {
+	return t.requestPeers(ctx, peerID, port)
+}
+
+func (t *TorrentFile) requestPeers(ctx context.Context, peerID [20]byte, port uint16) ([]logic.Peer, error) {
+	u, err := url.Parse(t.Announce)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("info_hash", string(t.InfoHash[:]))
+	query.Set("peer_id", string(peerID[:]))
+	query.Set("port", strconv.Itoa(int(port)))
+	u.RawQuery = query.Encode()
 	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -131,61 +228,155 @@ func (tf *TorrentFile) SaveTorrentFile(filePath string, filename string, hashmap
 		return err
 	}
 
-	err = UpdateInfoHash(tf.InfoHash, filePath, hashmapPath)
-	if err != nil {
-		return err
-	}
-	return nil
+	// 生成种子的一方拥有全部数据
+	return tf.Record(hashmapPath, filePath, func(e *library.Entry) {
+		e.Bitfield = make(bitfield.Bitfield, (len(tf.PieceHashes)+7)/8)
+		for i := range tf.PieceHashes {
+			e.Bitfield.SetPiece(i)
+		}
+		if e.Completed.IsZero() {
+			e.Completed = time.Now()
+		}
+	})
 }
 
+// LoadTorrentFile 读取种子文件，可以是 bencode 格式的 .torrent 文件，
+// 也可以是 SaveTorrentFile 保存的 json
 func LoadTorrentFile(filename string) (TorrentFile, error) {
-	// 从文件中读取 JSON 数据
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	tf, err := ParseMetainfo(data)
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return tf, nil
+}
 
-	// 将 JSON 数据解码为结构体
-	var tf TorrentFile
-	err = json.Unmarshal(data, &tf)
+// ParseMetainfo 解析种子：先按 bencode 格式的 .torrent 文件解析，
+// 不是 bencode 时按 SaveTorrentFile 保存的 json 解析
+func ParseMetainfo(data []byte) (TorrentFile, error) {
+	tf, err := parseBencode(data)
+	if err != nil {
+		if len(data) > 0 && data[0] == 'd' {
+			return TorrentFile{}, err
+		}
+		tf = TorrentFile{}
+		err = json.Unmarshal(data, &tf)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	err = tf.Validate()
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	return tf, nil
+}
 
+// parseBencode 解析 bencode 格式的 .torrent 文件。infohash 是 info 字典
+// 重新编码后的 SHA-1，字典的键按规范排序，未知的键也保留在内
+func parseBencode(data []byte) (TorrentFile, error) {
+	var bt bencodeTorrent
+	err := bencode.Unmarshal(bytes.NewReader(data), &bt)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	raw, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	dict, _ := raw.(map[string]interface{})
+	info, ok := dict["info"].(map[string]interface{})
+	if !ok {
+		return TorrentFile{}, errors.New("torrent has no info dictionary")
+	}
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	if len(bt.Info.Pieces)%20 != 0 {
+		return TorrentFile{}, errors.New("malformed pieces in torrent")
+	}
+	tf := TorrentFile{
+		Announce:    bt.Announce,
+		InfoHash:    sha1.Sum(buf.Bytes()),
+		PieceLength: bt.Info.PieceLength,
+		Length:      bt.Info.Length,
+		Name:        bt.Info.Name,
+	}
+	for i := 0; i < len(bt.Info.Pieces); i += 20 {
+		var hash [20]byte
+		copy(hash[:], bt.Info.Pieces[i:i+20])
+		tf.PieceHashes = append(tf.PieceHashes, hash)
+	}
+	if len(bt.Info.Files) > 0 {
+		tf.Length = 0
+		for _, f := range bt.Info.Files {
+			tf.Files = append(tf.Files, protocol.File{Path: strings.Join(f.Path, "/"), Length: f.Length})
+			tf.Length += f.Length
+		}
+	}
+	// 各项大小由 ParseMetainfo 调用 Validate 检查
 	return tf, nil
 }
 
+// NewTorrentFile 为文件生成种子信息。filename 为目录时生成多文件种子，
+// 目录中的文件按路径排序后首尾相接地切分为数据块
 func NewTorrentFile(filename, announce string, pieceLength int) (*TorrentFile, error) {
-	file, err := os.Open(filename)
+	fileInfo, err := os.Stat(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
+	var files []protocol.File
+	paths := []string{filename}
+	if fileInfo.IsDir() {
+		paths = nil
+		err = filepath.WalkDir(filename, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(filename, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+			files = append(files, protocol.File{Path: filepath.ToSlash(rel), Length: int(info.Size())})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	fileSize := fileInfo.Size()
 
-	numPieces := fileSize / int64(pieceLength)
-	if fileSize%int64(pieceLength) != 0 {
-		numPieces++
+	pieceHashes, fileSize, err := hashPieces(paths, pieceLength)
+	if err != nil {
+		return nil, err
 	}
 
-	pieceHashes := make([][20]byte, numPieces)
-	buf := make([]byte, pieceLength)
-	for i := 0; i < int(numPieces); i++ {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
+	infoString := "d"
+	if files == nil {
+		infoString += "6:lengthi" + legacyLength(fileSize) + "e"
+	} else {
+		infoString += "5:filesl"
+		for _, f := range files {
+			infoString += "d6:lengthi" + strconv.Itoa(f.Length) + "e4:pathl"
+			for _, elem := range strings.Split(f.Path, "/") {
+				infoString += strconv.Itoa(len(elem)) + ":" + elem
+			}
+			infoString += "ee"
 		}
-		hash := sha1.Sum(buf[:n])
-		// fmt.Printf("buf: %v, hash: %v\n", string(buf[:n]), hash)
-		pieceHashes[i] = hash
+		infoString += "e"
 	}
-
-	infoString := "d6:lengthi" + string(fileSize) + "e4:name" + strconv.Itoa(len(fileInfo.Name())) + ":" + fileInfo.Name() + "12:piece lengthi" + strconv.Itoa(pieceLength) + "e6:pieces" + strconv.Itoa(len(pieceHashes)*20) + ":"
+	infoString += "4:name" + strconv.Itoa(len(fileInfo.Name())) + ":" + fileInfo.Name() + "12:piece lengthi" + strconv.Itoa(pieceLength) + "e6:pieces" + strconv.Itoa(len(pieceHashes)*20) + ":"
 	for _, hash := range pieceHashes {
 		infoString += string(hash[:])
 	}
@@ -200,75 +391,192 @@ func NewTorrentFile(filename, announce string, pieceLength int) (*TorrentFile, e
 		PieceLength: pieceLength,
 		Length:      int(fileSize),
 		Name:        fileInfo.Name(),
+		Files:       files,
 	}
 
 	return torrentFile, nil
 }
 
-func UpdateInfoHash(infoHash [20]byte, filePath string, hashmapPath string) error {
-	infoHashMap, err := ReadInfoHashFile(hashmapPath)
-	if err != nil {
-		return err
+// legacyLength 按最初的写法 string(fileSize) 编码单文件种子的长度，即把长度
+// 当作一个字符，以免改变已有种子的 infohash
+func legacyLength(n int64) string {
+	if n < 0 || n > utf8.MaxRune {
+		return string(utf8.RuneError)
 	}
+	return string(rune(n))
+}
 
-	infoHashMap[infoHash] = filePath
+// hashPieces 将多个文件视为连续的数据并计算每个数据块的 SHA-1 哈希值
+func hashPieces(paths []string, pieceLength int) ([][20]byte, int64, error) {
+	var pieceHashes [][20]byte
+	var total int64
+	buf := make([]byte, pieceLength)
+	n := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		for {
+			m, err := io.ReadFull(file, buf[n:])
+			n += m
+			total += int64(m)
+			if n == pieceLength {
+				pieceHashes = append(pieceHashes, sha1.Sum(buf))
+				n = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, 0, err
+			}
+		}
+		file.Close()
+	}
+	if n > 0 {
+		pieceHashes = append(pieceHashes, sha1.Sum(buf[:n]))
+	}
+	return pieceHashes, total, nil
+}
 
-	err = writeInfoHashFile(infoHashMap, hashmapPath)
+// UpdateInfoHash 在 hashmapPath 处的种子库中记录种子数据的存放位置
+func UpdateInfoHash(infoHash [20]byte, filePath string, hashmapPath string) error {
+	db, err := library.Open(hashmapPath)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return db.Update(func(entries map[[20]byte]*library.Entry) error {
+		e := entries[infoHash]
+		if e == nil {
+			e = &library.Entry{Name: filepath.Base(filePath), Added: time.Now()}
+			entries[infoHash] = e
+		}
+		e.Path = filePath
+		return nil
+	})
 }
 
+// ReadInfoHashFile 返回种子库中每个种子的数据存放位置
 func ReadInfoHashFile(hashmapPath string) (map[[20]byte]string, error) {
-	var tempMap map[string]string
-
-	infoHashMap := make(map[[20]byte]string)
-
-	data, err := ioutil.ReadFile(hashmapPath)
-	if err != nil && !os.IsNotExist(err) {
+	db, err := library.Open(hashmapPath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := db.All()
+	if err != nil {
 		return nil, err
 	}
+	infoHashMap := make(map[[20]byte]string, len(entries))
+	for infoHash, e := range entries {
+		infoHashMap[infoHash] = e.Path
+	}
+	return infoHashMap, nil
+}
 
-	if len(data) > 0 {
-		err = json.Unmarshal(data, &tempMap)
-		if err != nil {
-			return nil, err
+// Record saves the torrent's metadata in the library at dbPath along with
+// where its data is stored; fn fills in the rest of the entry
+func (t *TorrentFile) Record(dbPath, dataPath string, fn func(e *library.Entry)) error {
+	metadata, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	db, err := library.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(entries map[[20]byte]*library.Entry) error {
+		e := entries[t.InfoHash]
+		if e == nil {
+			e = &library.Entry{Added: time.Now()}
+			entries[t.InfoHash] = e
 		}
+		e.Name = t.Name
+		e.Path = dataPath
+		e.Torrent = metadata
+		fn(e)
+		return nil
+	})
+}
+
+// FromEntry returns the torrent described by a library entry
+func FromEntry(e *library.Entry) (TorrentFile, error) {
+	var tf TorrentFile
+	if len(e.Torrent) == 0 {
+		return tf, fmt.Errorf("no metadata recorded for %s", e.Path)
+	}
+	err := json.Unmarshal(e.Torrent, &tf)
+	if err != nil {
+		return tf, err
 	}
+	return tf, tf.Validate()
+}
 
-	for k, v := range tempMap {
-		// 将编码后的字符串键转换回原始类型[20]byte
-		var key [20]uint8
-		keyBytes, err := hex.DecodeString(k)
+// ParseMagnet 解析 magnet 链接，返回其中的 infohash 和文件名（dn，可能为空）。
+// infohash 可以是 40 位十六进制或 32 位 base32 编码
+func ParseMagnet(uri string) (infoHash [20]byte, name string, err error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return infoHash, "", err
+	}
+	if u.Scheme != "magnet" {
+		return infoHash, "", fmt.Errorf("not a magnet link: %q", uri)
+	}
+	query := u.Query()
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		hash := strings.TrimPrefix(xt, "urn:btih:")
+		var b []byte
+		switch len(hash) {
+		case 40:
+			b, err = hex.DecodeString(hash)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("bad infohash length %d", len(hash))
+		}
 		if err != nil {
-			// 处理错误
-			return nil, err
+			return infoHash, "", fmt.Errorf("magnet link %q: %w", uri, err)
 		}
-		copy(key[:], keyBytes)
-		infoHashMap[key] = v
+		copy(infoHash[:], b)
+		return infoHash, query.Get("dn"), nil
 	}
+	return infoHash, "", fmt.Errorf("magnet link %q has no btih infohash", uri)
+}
 
-	return infoHashMap, nil
+// MagnetLink 返回种子的 magnet 链接
+func (t *TorrentFile) MagnetLink() string {
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(t.InfoHash[:]) + "&dn=" + url.QueryEscape(t.Name)
 }
 
-func writeInfoHashFile(infoHashMap map[[20]byte]string, hashmapPath string) error {
-	tempMap := make(map[string]string)
-	for k, v := range infoHashMap {
-		// 因为json只能将string作为key，而不能将[20]byte作为key，所以将键转换为字符串
-		keyStr := hex.EncodeToString(k[:])
-		tempMap[keyStr] = v
+// ResolveMagnet 查找 magnet 链接对应的种子。没有从其他 peer 获取元数据的途径，
+// 因此只能在 libraryPath 处的种子库和 torrentDir 中保存的种子里查找
+func ResolveMagnet(uri, libraryPath, torrentDir string) (*TorrentFile, error) {
+	infoHash, _, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
 	}
-	data, err := json.Marshal(tempMap)
+	db, err := library.Open(libraryPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	err = ioutil.WriteFile(hashmapPath, data, 0644)
+	e, err := db.Get(infoHash)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	if e != nil && len(e.Torrent) > 0 {
+		t, err := FromEntry(e)
+		return &t, err
+	}
+	files, _ := filepath.Glob(filepath.Join(torrentDir, "*.json"))
+	for _, f := range files {
+		t, err := LoadTorrentFile(f)
+		if err == nil && t.InfoHash == infoHash {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("no metadata known for infohash %x", infoHash)
 }
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Errors of Validate
+var (
+	// ErrUnsafePath is returned for metainfo naming a path that would end
+	// up outside of where the torrent is saved
+	ErrUnsafePath = errors.New("unsafe path in metainfo")
+
+	// ErrMalformed is returned for metainfo whose sizes do not add up
+	ErrMalformed = errors.New("malformed metainfo")
+)
+
+// CheckName checks that the name of a torrent is a single path element, so
+// that saving the torrent in a directory stays inside of it
+func CheckName(name string) error {
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) || !filepath.IsLocal(name) {
+		return fmt.Errorf("%w: name %q", ErrUnsafePath, name)
+	}
+	return nil
+}
+
+// Validate checks metainfo before anything is stored from it. Its name must
+// pass CheckName, and every file of a multi-file torrent needs a relative
+// slash separated path without empty, "." or ".." elements, used by no other
+// file. The sizes must add up: a positive piece length, one hash per piece
+// of Length, and files of non-negative lengths summing to Length.
+func (t *TorrentFile) Validate() error {
+	err := CheckName(t.Name)
+	if err != nil {
+		return err
+	}
+	if t.PieceLength <= 0 {
+		return fmt.Errorf("%w: piece length %d", ErrMalformed, t.PieceLength)
+	}
+	if t.Length < 0 {
+		return fmt.Errorf("%w: length %d", ErrMalformed, t.Length)
+	}
+	if pieces := (t.Length + t.PieceLength - 1) / t.PieceLength; len(t.PieceHashes) != pieces {
+		return fmt.Errorf("%w: %d pieces for %d bytes", ErrMalformed, len(t.PieceHashes), t.Length)
+	}
+	seen := make(map[string]bool, len(t.Files))
+	total := 0
+	for _, f := range t.Files {
+		if f.Length < 0 {
+			return fmt.Errorf("%w: file %q has length %d", ErrMalformed, f.Path, f.Length)
+		}
+		total += f.Length
+		for _, elem := range strings.Split(f.Path, "/") {
+			if elem == "" || elem == "." || elem == ".." || strings.Contains(elem, `\`) {
+				return fmt.Errorf("%w: file %q", ErrUnsafePath, f.Path)
+			}
+		}
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return fmt.Errorf("%w: file %q", ErrUnsafePath, f.Path)
+		}
+		if seen[f.Path] {
+			return fmt.Errorf("%w: duplicate file %q", ErrMalformed, f.Path)
+		}
+		seen[f.Path] = true
+	}
+	if len(t.Files) > 0 && total != t.Length {
+		return fmt.Errorf("%w: files of %d bytes for a length of %d", ErrMalformed, total, t.Length)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package tracker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/lvkeliang/P2Pin3/metrics"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often peers are asked to announce themselves
+const DefaultInterval = 30 * time.Second
+
+// Peer is how a peer is listed in announce responses
+type Peer struct {
+	ID   string `json:"id"`
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+// TrackerResponse is the JSON answer to an announce
+type TrackerResponse struct {
+	Interval int    `json:"interval,omitempty"` // seconds
+	Peers    []Peer `json:"peers"`
+}
+
+// Tracker answers announces with the peers seeding a torrent. A peer
+// announcing a non-zero port is remembered for the torrent until it misses
+// two announce intervals; peers announcing port 0 only download.
+// Static peers are returned for every torrent.
+type Tracker struct {
+	Static   []Peer
+	Interval time.Duration
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]map[string]*announced // keyed by infohash, then address
+	announces map[string]int64                   // answered so far, keyed by event
+	latency   *metrics.Histogram                 // time taken to answer announces
+}
+
+type announced struct {
+	peer Peer
+	seen time.Time
+}
+
+// New creates a tracker that also returns the static peers
+func New(static []Peer) *Tracker {
+	return &Tracker{
+		Static:   static,
+		Interval: DefaultInterval,
+		swarms:   make(map[[20]byte]map[string]*announced),
+	}
+}
+
+// WriteMetrics writes how many announces were answered and how fast, and
+// the size of the swarm of every torrent, labelled with its infohash
+func (t *Tracker) WriteMetrics(w *metrics.Writer) {
+	swarms := t.Swarms()
+	t.mu.Lock()
+	events := make([]string, 0, len(t.announces))
+	for event := range t.announces {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		w.Counter("p2pin3_tracker_announces_total", "Announces answered by the tracker, by event.",
+			float64(t.announces[event]), "event", event)
+	}
+	latency := t.latency
+	t.mu.Unlock()
+	w.Histogram("p2pin3_tracker_announce_duration_seconds", "Time taken by the tracker to answer announces.", latency)
+	w.Gauge("p2pin3_tracker_swarms", "Torrents with announced peers.", float64(len(swarms)))
+
+	infoHashes := make([]string, 0, len(swarms))
+	sizes := make(map[string]int, len(swarms))
+	for infoHash, n := range swarms {
+		s := hex.EncodeToString(infoHash[:])
+		infoHashes = append(infoHashes, s)
+		sizes[s] = n
+	}
+	sort.Strings(infoHashes)
+	for _, infoHash := range infoHashes {
+		w.Gauge("p2pin3_tracker_swarm_peers", "Live peers announced for a torrent.", float64(sizes[infoHash]), "infohash", infoHash)
+	}
+}
+
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	query := r.URL.Query()
+	var peers []Peer
+	infoHash, ok := parseInfoHash(query.Get("info_hash"))
+	if ok {
+		peers = t.announce(infoHash, r, query.Get("peer_id"), query.Get("port"), query.Get("event"))
+	}
+	defer t.count(query.Get("event"), start)
+
+	// 构造响应数据
+	response := TrackerResponse{
+		Interval: int(t.Interval / time.Second),
+		Peers:    append(append([]Peer{}, t.Static...), peers...),
+	}
+
+	// 将响应数据编码为 JSON 字符串
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 设置响应头
+	w.Header().Set("Content-Type", "application/json")
+
+	// 发送响应数据
+	w.Write(data)
+}
+
+// announce records the peer behind r and returns the other live peers of
+// the torrent
+func (t *Tracker) announce(infoHash [20]byte, r *http.Request, peerID, portParam, event string) []Peer {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	port, _ := strconv.Atoi(portParam)
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	swarm := t.swarms[infoHash]
+	if swarm == nil {
+		swarm = make(map[string]*announced)
+		t.swarms[infoHash] = swarm
+	}
+	now := time.Now()
+	switch {
+	case event == "stopped":
+		delete(swarm, addr)
+	case port > 0 && port < 65536:
+		swarm[addr] = &announced{
+			peer: Peer{ID: hex.EncodeToString([]byte(peerID)), IP: ip, Port: port},
+			seen: now,
+		}
+	}
+
+	var peers []Peer
+	for a, p := range swarm {
+		if now.Sub(p.seen) > 2*t.Interval {
+			delete(swarm, a)
+			continue
+		}
+		if a != addr {
+			peers = append(peers, p.peer)
+		}
+	}
+	if len(swarm) == 0 {
+		delete(t.swarms, infoHash)
+	}
+	return peers
+}
+
+// count records an announce answered since start
+func (t *Tracker) count(event string, start time.Time) {
+	switch event {
+	case "started", "completed", "stopped":
+	default:
+		// Keep the labels to a known few whatever clients send
+		event = "none"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.announces == nil {
+		t.announces = make(map[string]int64)
+		t.latency = metrics.NewHistogram()
+	}
+	t.announces[event]++
+	t.latency.Observe(time.Since(start).Seconds())
+}
+
+// Swarms returns the number of peers announced for each torrent, expired
+// peers included until the next announce of the torrent
+func (t *Tracker) Swarms() map[[20]byte]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[[20]byte]int, len(t.swarms))
+	for infoHash, swarm := range t.swarms {
+		counts[infoHash] = len(swarm)
+	}
+	return counts
+}
+
+// parseInfoHash accepts the raw 20 bytes of the BitTorrent spec or 40 hex
+// digits
+func parseInfoHash(s string) ([20]byte, bool) {
+	var infoHash [20]byte
+	switch len(s) {
+	case 20:
+		copy(infoHash[:], s)
+		return infoHash, true
+	case 40:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return infoHash, false
+		}
+		copy(infoHash[:], b)
+		return infoHash, true
+	}
+	return infoHash, false
+}
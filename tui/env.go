@@ -0,0 +1,20 @@
+package tui
+
+import (
+	"os"
+	"strconv"
+)
+
+// envSize reads the size of the terminal from $COLUMNS and $LINES, 80x24
+// when they are not set
+func envSize() (int, int) {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	height, err := strconv.Atoi(os.Getenv("LINES"))
+	if err != nil || height <= 0 {
+		height = 24
+	}
+	return width, height
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tui
+
+import "io"
+
+// terminalSize falls back to the environment where the terminal cannot be
+// asked for its size
+func terminalSize(out io.Writer) (int, int) {
+	return envSize()
+}
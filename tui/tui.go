@@ -0,0 +1,358 @@
+package tui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/bitfield"
+	"github.com/lvkeliang/P2Pin3/protocol"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxPeers is how many peers are listed under a torrent
+const maxPeers = 10
+
+// Torrent is what the screen shows about a torrent
+type Torrent struct {
+	Key      string // identifies the torrent across snapshots, like its infohash
+	Name     string
+	Status   string // as given by session.Status.String, like "downloading"
+	Error    string
+	Progress protocol.Progress
+	Uploaded int64
+
+	NumPieces int
+	Pieces    bitfield.Bitfield // the pieces that are there
+
+	Peers   []Peer
+	Tracker torrent.TrackerStatus
+}
+
+// Peer is a connection of a torrent
+type Peer struct {
+	Addr           string
+	Upload         bool    // whether the peer downloads from us rather than us from it
+	Rate           float64 // download rate, bytes per second
+	Downloaded     int64
+	Uploaded       int64
+	Backlog        int
+	Choked         bool // whether the peer is choking us
+	Interested     bool // whether we want the peer's pieces
+	PeerInterested bool // whether the peer wants ours
+}
+
+var statusNames = map[string]string{
+	"stopped":     "已暂停",
+	"downloading": "下载中",
+	"seeding":     "做种中",
+	"error":       "出错",
+	"queued":      "排队下载",
+	"seed-queued": "排队做种",
+}
+
+// Screen draws snapshots of torrents on a terminal
+type Screen struct {
+	Out io.Writer
+
+	// Width and Height give the size of the terminal; it is asked to the
+	// terminal, or taken from $COLUMNS and $LINES, when they are zero
+	Width, Height int
+
+	uploads map[string]upload // previous upload totals, to derive rates
+}
+
+type upload struct {
+	total int64
+	time  time.Time
+	rate  float64
+}
+
+// Run redraws the torrents returned by snapshot every interval on the
+// alternate screen of the terminal, until ctx is done
+func (s *Screen) Run(ctx context.Context, interval time.Duration, snapshot func() ([]Torrent, error)) error {
+	// Switch to the alternate screen and hide the cursor, then restore both
+	_, err := io.WriteString(s.Out, "\x1b[?1049h\x1b[?25l")
+	if err != nil {
+		return err
+	}
+	defer io.WriteString(s.Out, "\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		torrents, err := snapshot()
+		err = s.Draw(torrents, err)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Draw draws a snapshot over the previous one. A snapshot that failed is
+// shown as its error.
+func (s *Screen) Draw(torrents []Torrent, snapshotErr error) error {
+	width, height := s.size()
+	var buf bytes.Buffer
+	if snapshotErr != nil {
+		fmt.Fprintf(&buf, "错误: %v\n", snapshotErr)
+	} else {
+		s.Render(&buf, torrents, width)
+	}
+
+	// Overwrite the screen line by line rather than clearing it, so it does
+	// not flicker
+	var frame bytes.Buffer
+	frame.WriteString("\x1b[H")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if height > 0 && len(lines) > height {
+		lines = lines[:height]
+	}
+	for i, line := range lines {
+		frame.WriteString(truncate(line, width))
+		frame.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			frame.WriteString("\r\n")
+		}
+	}
+	frame.WriteString("\x1b[J")
+	_, err := s.Out.Write(frame.Bytes())
+	return err
+}
+
+func (s *Screen) size() (int, int) {
+	width, height := s.Width, s.Height
+	if width <= 0 || height <= 0 {
+		w, h := terminalSize(s.Out)
+		if width <= 0 {
+			width = w
+		}
+		if height <= 0 {
+			height = h
+		}
+	}
+	return width, height
+}
+
+// Render writes a snapshot of torrents as text lines at most width wide
+func (s *Screen) Render(w io.Writer, torrents []Torrent, width int) {
+	now := time.Now()
+	var down, up float64
+	for i := range torrents {
+		down += torrents[i].Progress.Rate
+		up += s.uploadRate(&torrents[i], now)
+	}
+	fmt.Fprintf(w, "P2Pin3  %d 个种子  下载 %s  上传 %s  %s\n",
+		len(torrents), formatRate(down), formatRate(up), now.Format("15:04:05"))
+	fmt.Fprintln(w, "标志: I 我方感兴趣  C 被对方阻塞  i 对方感兴趣    Ctrl-C 退出")
+
+	for i := range torrents {
+		fmt.Fprintln(w)
+		s.renderTorrent(w, &torrents[i], width, now)
+	}
+}
+
+func (s *Screen) renderTorrent(w io.Writer, t *Torrent, width int, now time.Time) {
+	p := t.Progress
+	status := statusNames[t.Status]
+	if status == "" {
+		status = t.Status
+	}
+	eta := "--"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	fmt.Fprintf(w, "%s  [%s]  下载 %s  上传 %s  剩余 %s  %d 个节点\n",
+		t.Name, status, formatRate(p.Rate), formatRate(s.uploads[t.Key].rate), eta, p.Peers)
+	if t.Error != "" {
+		fmt.Fprintf(w, "  错误: %s\n", t.Error)
+	}
+
+	info := fmt.Sprintf(" %6.2f%%  %d/%d 块  %s/%s", p.Percent(), p.PiecesDone, p.PiecesTotal,
+		formatBytes(p.BytesDone), formatBytes(p.BytesTotal))
+	barWidth := width - 4 - displayWidth(info)
+	if barWidth > 60 {
+		barWidth = 60
+	}
+	fmt.Fprintf(w, "  [%s]%s\n", progressBar(p.Percent()/100, barWidth), info)
+	if t.NumPieces > 0 {
+		fmt.Fprintf(w, "  %s\n", pieceMap(t.Pieces, t.NumPieces, width-4))
+	}
+
+	tr := t.Tracker
+	switch {
+	case tr.URL == "":
+		fmt.Fprintln(w, "  tracker: 无")
+	case tr.Time.IsZero():
+		fmt.Fprintf(w, "  tracker: %s  尚未报告\n", tr.URL)
+	case tr.Error != "":
+		fmt.Fprintf(w, "  tracker: %s  %s前失败: %s\n", tr.URL, ago(now, tr.Time), tr.Error)
+	default:
+		fmt.Fprintf(w, "  tracker: %s  %s前返回 %d 个节点\n", tr.URL, ago(now, tr.Time), tr.Peers)
+	}
+
+	if len(t.Peers) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s %s %s %s %s %s %s\n", pad("地址", 22), pad("方向", 4), pad("速度", 11),
+		pad("已下载", 10), pad("已上传", 10), pad("队列", 4), "标志")
+	for i, peer := range t.Peers {
+		if i == maxPeers {
+			fmt.Fprintf(w, "  …还有 %d 个节点\n", len(t.Peers)-maxPeers)
+			break
+		}
+		direction, rate, backlog := "上传", "", ""
+		if !peer.Upload {
+			direction, rate, backlog = "下载", formatRate(peer.Rate), fmt.Sprint(peer.Backlog)
+		}
+		fmt.Fprintf(w, "  %s %s %s %s %s %s %s\n", pad(peer.Addr, 22), pad(direction, 4), pad(rate, 11),
+			pad(formatBytes(peer.Downloaded), 10), pad(formatBytes(peer.Uploaded), 10), pad(backlog, 4), flags(peer))
+	}
+}
+
+// uploadRate derives the upload rate of a torrent from its upload total
+// between two snapshots
+func (s *Screen) uploadRate(t *Torrent, now time.Time) float64 {
+	if s.uploads == nil {
+		s.uploads = make(map[string]upload)
+	}
+	last, ok := s.uploads[t.Key]
+	u := upload{total: t.Uploaded, time: now, rate: last.rate}
+	if ok && now.Sub(last.time) > 0 {
+		u.rate = float64(t.Uploaded-last.total) / now.Sub(last.time).Seconds()
+	}
+	s.uploads[t.Key] = u
+	return u.rate
+}
+
+func flags(p Peer) string {
+	f := []byte("   ")
+	if p.Interested {
+		f[0] = 'I'
+	}
+	if p.Choked {
+		f[1] = 'C'
+	}
+	if p.PeerInterested {
+		f[2] = 'i'
+	}
+	return string(f)
+}
+
+func progressBar(done float64, width int) string {
+	if width < 1 {
+		return ""
+	}
+	full := int(done * float64(width))
+	if full > width {
+		full = width
+	}
+	return strings.Repeat("#", full) + strings.Repeat("-", width-full)
+}
+
+// pieceMap draws the pieces in width characters, each standing for a run of
+// pieces and shaded by how many of them are there
+func pieceMap(pieces bitfield.Bitfield, numPieces, width int) string {
+	if width > numPieces {
+		width = numPieces
+	}
+	if width < 1 {
+		return ""
+	}
+	shades := []rune(" ░▒▓█")
+	var b strings.Builder
+	for c := 0; c < width; c++ {
+		first, last := c*numPieces/width, (c+1)*numPieces/width
+		done := 0
+		for i := first; i < last; i++ {
+			if pieces.HasPiece(i) {
+				done++
+			}
+		}
+		shade := 0
+		switch {
+		case done == last-first:
+			shade = len(shades) - 1
+		case done > 0:
+			shade = 1 + done*(len(shades)-2)/(last-first)
+		}
+		b.WriteRune(shades[shade])
+	}
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+func formatRate(rate float64) string {
+	return formatBytes(int64(rate)) + "/s"
+}
+
+func ago(now, t time.Time) string {
+	return now.Sub(t).Round(time.Second).String()
+}
+
+// displayWidth counts the terminal columns of s; CJK characters take two
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6:
+		return 2
+	}
+	return 1
+}
+
+// pad pads s with spaces to width columns
+func pad(s string, width int) string {
+	w := displayWidth(s)
+	if w >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-w)
+}
+
+// truncate cuts s to width columns
+func truncate(s string, width int) string {
+	if width <= 0 || displayWidth(s) <= width {
+		return s
+	}
+	w := 0
+	for i, r := range s {
+		w += runeWidth(r)
+		if w > width {
+			return s[:i]
+		}
+	}
+	return s
+}
@@ -0,0 +1,231 @@
+package watch
+
+import (
+	"context"
+	"github.com/lvkeliang/P2Pin3/hooks"
+	"github.com/lvkeliang/P2Pin3/library"
+	"github.com/lvkeliang/P2Pin3/logging"
+	"github.com/lvkeliang/P2Pin3/seeder"
+	"github.com/lvkeliang/P2Pin3/torrent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var logger = logging.For(logging.Watch)
+
+// Suffixes given to inbox files once they have been handled, so they are
+// not picked up again
+const (
+	AddedSuffix  = ".added"
+	FailedSuffix = ".failed"
+)
+
+// Watcher polls two folders: every file or directory dropped into ShareDir
+// gets a torrent created for it and is seeded, and every .torrent, .json or
+// .magnet file dropped into InboxDir is downloaded to DownloadDir. Torrent
+// files are bencoded .torrent files or the JSON metainfo written by
+// TorrentFile.SaveTorrentFile. Magnet links are only resolved against the
+// metainfo the library and TorrentDir already have, since it cannot be
+// fetched from peers.
+// A file is only handled once its size and modification time stop changing
+// between two polls, so files still being copied are left alone.
+type Watcher struct {
+	ShareDir    string
+	InboxDir    string
+	DownloadDir string
+	TorrentDir  string // where the metainfo of shared files is saved
+	LibraryPath string
+	Announce    string
+	PieceLength int
+	Interval    time.Duration
+
+	// Registry, when set, starts seeding shared files and finished
+	// downloads right away instead of waiting for it to reload the library
+	Registry *seeder.Registry
+
+	// Download runs a download started from the inbox. It defaults to
+	// TorrentFile.DownloadToFile.
+	Download func(ctx context.Context, t *torrent.TorrentFile, path string) error
+
+	// Hooks, when set, are told about every download from the inbox that
+	// completes
+	Hooks *hooks.Runner
+
+	stamps  map[string]stamp
+	handled map[string]stamp
+}
+
+type stamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// Run polls the folders every Interval until ctx is done. Downloads started
+// from the inbox are cancelled along with ctx.
+func (w *Watcher) Run(ctx context.Context) error {
+	for _, dir := range []string{w.ShareDir, w.InboxDir, w.DownloadDir, w.TorrentDir} {
+		if dir == "" {
+			continue
+		}
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	w.stamps = make(map[string]stamp)
+	w.handled = make(map[string]stamp)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if w.ShareDir != "" {
+			w.scan(w.ShareDir, w.share)
+		}
+		if w.InboxDir != "" {
+			w.scan(w.InboxDir, func(path string) { w.inbox(ctx, path) })
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan calls handle for every entry of dir that did not change since the
+// previous scan
+func (w *Watcher) scan(dir string, handle func(path string)) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Warn("cannot scan folder", "path", dir, logging.Err(err))
+		return
+	}
+	for _, info := range entries {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		s := stamp{size: info.Size(), modTime: info.ModTime()}
+		if info.IsDir() {
+			s = dirStamp(path)
+		}
+		last, ok := w.stamps[path]
+		w.stamps[path] = s
+		if ok && last == s && w.handled[path] != s {
+			w.handled[path] = s
+			handle(path)
+		}
+	}
+}
+
+// dirStamp sums up the files of a directory, so a directory being copied
+// is seen as changing
+func dirStamp(dir string) stamp {
+	var s stamp
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		s.size += info.Size()
+		if info.ModTime().After(s.modTime) {
+			s.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return s
+}
+
+// share creates a torrent for a file of ShareDir and seeds it, unless the
+// library already knows the file
+func (w *Watcher) share(path string) {
+	db, err := library.Open(w.LibraryPath)
+	if err != nil {
+		logger.Error("cannot open the library", "path", w.LibraryPath, logging.Err(err))
+		return
+	}
+	entries, err := db.All()
+	if err != nil {
+		logger.Error("cannot read the library", "path", w.LibraryPath, logging.Err(err))
+		return
+	}
+	for _, e := range entries {
+		if e.Path == path {
+			return
+		}
+	}
+
+	logger.Info("sharing", "path", path)
+	t, err := torrent.NewTorrentFile(path, w.Announce, w.PieceLength)
+	if err != nil {
+		logger.Warn("cannot share", "path", path, logging.Err(err))
+		return
+	}
+	err = t.SaveTorrentFile(path, filepath.Join(w.TorrentDir, filepath.Base(path)+".json"), w.LibraryPath)
+	if err != nil {
+		logger.Warn("cannot share", "path", path, logging.Err(err))
+		return
+	}
+	if w.Registry != nil {
+		w.Registry.Add(t, path)
+	}
+}
+
+// inbox starts downloading the torrent described by a file of InboxDir and
+// renames the file so it is handled once
+func (w *Watcher) inbox(ctx context.Context, path string) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".torrent" && ext != ".json" && ext != ".magnet" {
+		return
+	}
+	t, err := w.load(path)
+	if err != nil {
+		logger.Warn("cannot download", "path", path, logging.Err(err))
+		os.Rename(path, path+FailedSuffix)
+		return
+	}
+	err = os.Rename(path, path+AddedSuffix)
+	if err != nil {
+		logger.Error("cannot mark as added", "path", path, logging.Err(err))
+		return
+	}
+
+	log := logger.With(logging.InfoHash(t.InfoHash), "name", t.Name)
+	log.Info("downloading")
+	download := w.Download
+	if download == nil {
+		download = func(ctx context.Context, t *torrent.TorrentFile, path string) error {
+			return t.DownloadToFile(ctx, path, w.LibraryPath)
+		}
+	}
+	go func() {
+		out := filepath.Join(w.DownloadDir, t.Name)
+		err := download(ctx, t, out)
+		if err != nil {
+			log.Error("download failed", logging.Err(err))
+			return
+		}
+		log.Info("downloaded", "path", out)
+		w.Hooks.Fire(ctx, hooks.Completed(t, out))
+		if w.Registry != nil {
+			w.Registry.Add(t, out)
+		}
+	}()
+}
+
+// load reads a .torrent file or the metainfo saved by the torrent package,
+// or resolves a magnet link against the torrents the library and TorrentDir
+// know about
+func (w *Watcher) load(path string) (*torrent.TorrentFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "magnet:") {
+		return torrent.ResolveMagnet(string(data), w.LibraryPath, w.TorrentDir)
+	}
+	t, err := torrent.LoadTorrentFile(path)
+	return &t, err
+}
@@ -0,0 +1,136 @@
+package wiretrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ReplayTimeout bounds the wait for each message while replaying
+const ReplayTimeout = 30 * time.Second
+
+// Result sums up a replay
+type Result struct {
+	Conns    int // connections replayed
+	Sent     int // messages sent
+	Received int // messages received and found as recorded
+}
+
+// Replay connects to addr once per connection of a trace and plays the peer
+// that opened it: it sends what that peer sent, in the same order, and
+// checks that every message of the other side comes as recorded. A Piece
+// matches when its block has the recorded hash, a Handshake when it is for
+// the same infohash; keep-alives are not compared. An empty addr connects
+// to the address each connection was recorded with, which only works for
+// a trace of the peer that dialed.
+func Replay(ctx context.Context, addr string, records []Record) (Result, error) {
+	var res Result
+	var order []int
+	conns := make(map[int][]Record)
+	for _, r := range records {
+		if _, ok := conns[r.Conn]; !ok {
+			order = append(order, r.Conn)
+		}
+		conns[r.Conn] = append(conns[r.Conn], r)
+	}
+	for _, id := range order {
+		err := replayConn(ctx, addr, conns[id], &res)
+		if err != nil {
+			return res, fmt.Errorf("conn %d: %w", id, err)
+		}
+		res.Conns++
+	}
+	return res, nil
+}
+
+func replayConn(ctx context.Context, addr string, records []Record, res *Result) error {
+	if addr == "" {
+		addr = records[0].Remote
+	}
+	// The peer that opened the connection sent the first handshake
+	ours := records[0].Dir
+	dialer := net.Dialer{Timeout: ReplayTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	handshook := false
+	for i, r := range records {
+		if r.Dir == ours {
+			if r.Hash != "" {
+				return fmt.Errorf("record %d: cannot send %s, its block was not recorded", i+1, r.Message)
+			}
+			_, err = conn.Write(r.Data)
+			if err != nil {
+				return err
+			}
+			res.Sent++
+			continue
+		}
+		if r.Message == "KeepAlive" {
+			continue
+		}
+		var got Record
+		for {
+			conn.SetReadDeadline(time.Now().Add(ReplayTimeout))
+			got, err = readFrame(conn, !handshook)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("record %d: waiting for %s: %w", i+1, r.Message, err)
+			}
+			handshook = true
+			if got.Message != "KeepAlive" {
+				break
+			}
+		}
+		if got.Message != r.Message || got.Hash != r.Hash {
+			return fmt.Errorf("record %d: got %s, want %s", i+1, describe(got), describe(r))
+		}
+		res.Received++
+	}
+	return nil
+}
+
+// readFrame reads and decodes a handshake or message
+func readFrame(r io.Reader, handshake bool) (Record, error) {
+	var buf []byte
+	head := 4
+	if handshake {
+		head = 1
+	}
+	for {
+		n, ok := frameSize(buf, handshake)
+		if n < 0 {
+			return Record{}, errors.New("invalid message")
+		}
+		if ok && len(buf) == n {
+			return decode(buf, handshake), nil
+		}
+		more := head
+		if ok {
+			more = n - len(buf)
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, more)...)
+		_, err := io.ReadFull(r, buf[start:])
+		if err != nil {
+			return Record{}, err
+		}
+	}
+}
+
+func describe(r Record) string {
+	if r.Hash != "" {
+		return r.Message + " hash=" + r.Hash
+	}
+	return r.Message
+}
@@ -0,0 +1,242 @@
+// Package wiretrace records the messages exchanged with peers, one JSON
+// line per message, and replays the recorded traces against a seeder.
+package wiretrace
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lvkeliang/P2Pin3/logic"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of a record
+const (
+	Send = "send"
+	Recv = "recv"
+)
+
+// maxFrame is the largest message decoded; a connection sending a bigger
+// one is not traced any further
+const maxFrame = 1 << 24
+
+// Record is a message sent or received on a connection
+type Record struct {
+	Time   time.Time `json:"time"`
+	Conn   int       `json:"conn"` // numbers the connections of a trace from 1
+	Remote string    `json:"remote"`
+	Dir    string    `json:"dir"`
+
+	// Message is the decoded message, like "Request index=3 begin=0
+	// length=16384"
+	Message string `json:"message"`
+	Size    int    `json:"size"` // bytes on the wire
+
+	// Data is the message as sent on the wire. For a Piece it stops before
+	// the block, which is summed up by Hash instead.
+	Data []byte `json:"data"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Tracer writes the records of the connections it wraps. It is safe for
+// concurrent use; a nil Tracer traces nothing.
+type Tracer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	conns  int
+	err    error // of the first write that failed
+}
+
+// New creates a tracer writing to w
+func New(w io.Writer) *Tracer {
+	return &Tracer{w: w}
+}
+
+// Create creates a tracer writing to the file at path, replacing it
+func Create(path string) (*Tracer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t := New(f)
+	t.closer = f
+	return t, nil
+}
+
+// Close closes the file of Create. It returns the first error met writing
+// the trace.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closer != nil {
+		err := t.closer.Close()
+		if t.err == nil {
+			t.err = err
+		}
+	}
+	return t.err
+}
+
+// Conn returns c recording what is written to and read from it. Both
+// directions begin with a handshake, followed by length prefixed messages.
+func (t *Tracer) Conn(c net.Conn) net.Conn {
+	if t == nil {
+		return c
+	}
+	t.mu.Lock()
+	t.conns++
+	id := t.conns
+	t.mu.Unlock()
+	tc := &conn{Conn: c}
+	remote := c.RemoteAddr().String()
+	tc.sent = decoder{t: t, conn: id, remote: remote, dir: Send}
+	tc.received = decoder{t: t, conn: id, remote: remote, dir: Recv}
+	return tc
+}
+
+func (t *Tracer) write(r Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	line, err := json.Marshal(r)
+	if err == nil {
+		_, err = t.w.Write(append(line, '\n'))
+	}
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+type conn struct {
+	net.Conn
+	sent, received decoder
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.feed(p[:n])
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.feed(p[:n])
+	return n, err
+}
+
+// decoder cuts one direction of a connection into messages
+type decoder struct {
+	t      *Tracer
+	conn   int
+	remote string
+	dir    string
+
+	mu        sync.Mutex
+	buf       []byte
+	handshook bool
+	broken    bool // the stream made no sense
+}
+
+func (d *decoder) feed(p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.broken || len(p) == 0 {
+		return
+	}
+	d.buf = append(d.buf, p...)
+	for {
+		n, ok := frameSize(d.buf, !d.handshook)
+		if n < 0 {
+			d.broken = true
+			d.buf = nil
+			return
+		}
+		if !ok || len(d.buf) < n {
+			return
+		}
+		r := decode(d.buf[:n], !d.handshook)
+		r.Time = time.Now()
+		r.Conn = d.conn
+		r.Remote = d.remote
+		r.Dir = d.dir
+		d.t.write(r)
+		d.handshook = true
+		d.buf = append(d.buf[:0], d.buf[n:]...)
+	}
+}
+
+// frameSize returns the size of the handshake or message at the start of
+// buf, ok being false while too little of it is there to tell. It is
+// negative when buf does not hold a valid one.
+func frameSize(buf []byte, handshake bool) (n int, ok bool) {
+	if handshake {
+		if len(buf) < 1 {
+			return 0, false
+		}
+		if buf[0] == 0 {
+			return -1, true
+		}
+		return 49 + int(buf[0]), true
+	}
+	if len(buf) < 4 {
+		return 0, false
+	}
+	length := binary.BigEndian.Uint32(buf[0:4])
+	if length > maxFrame {
+		return -1, true
+	}
+	return 4 + int(length), true
+}
+
+// decode describes a whole handshake or message as it is on the wire
+func decode(frame []byte, handshake bool) Record {
+	r := Record{Size: len(frame), Data: append([]byte(nil), frame...)}
+	if handshake {
+		pstrlen := int(frame[0])
+		infoHash := frame[1+pstrlen+8 : 1+pstrlen+8+20]
+		r.Message = fmt.Sprintf("Handshake infohash=%x", infoHash)
+		return r
+	}
+	var msg *logic.Message
+	if len(frame) > 4 {
+		msg = &logic.Message{ID: logic.MessageID(frame[4]), Payload: frame[5:]}
+	}
+	r.Message = msg.String()
+	if msg != nil && msg.ID == logic.MsgPiece && len(msg.Payload) >= 8 {
+		hash := sha1.Sum(msg.Payload[8:])
+		r.Hash = hex.EncodeToString(hash[:])
+		r.Data = r.Data[:4+1+8]
+	}
+	return r
+}
+
+// ReadFile reads the records of a trace
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	dec := json.NewDecoder(f)
+	for {
+		var r Record
+		err = dec.Decode(&r)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: record %d: %w", path, len(records)+1, err)
+		}
+		records = append(records, r)
+	}
+}